@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// csvChunkSize CSV 取り込みで 1 回の INSERT にまとめる行数
+var csvChunkSize = 1000
+
+func init() {
+	if n, err := strconv.Atoi(getEnv("CSV_CHUNK_SIZE", "")); err == nil && n > 0 {
+		csvChunkSize = n
+	}
+}
+
+// bulkInserter 行を溜めて chunkSize 行ごとに multi-row INSERT を発行する.
+// suffix は VALUES の後ろに付ける ON DUPLICATE KEY UPDATE 句など
+type bulkInserter struct {
+	tx          *sqlx.Tx
+	query       string
+	placeHolder string
+	suffix      string
+	chunkSize   int
+
+	rows int
+	args []interface{}
+}
+
+func newBulkInserter(tx *sqlx.Tx, query, placeHolder, suffix string, chunkSize int) *bulkInserter {
+	return &bulkInserter{
+		tx:          tx,
+		query:       query,
+		placeHolder: placeHolder,
+		suffix:      suffix,
+		chunkSize:   chunkSize,
+	}
+}
+
+func (b *bulkInserter) Add(args ...interface{}) error {
+	b.args = append(b.args, args...)
+	b.rows++
+	if b.rows >= b.chunkSize {
+		return b.Flush()
+	}
+	return nil
+}
+
+// Flush 溜まっている行を INSERT する
+func (b *bulkInserter) Flush() error {
+	if b.rows == 0 {
+		return nil
+	}
+	placeHolders := strings.Repeat(","+b.placeHolder, b.rows)[1:]
+	_, err := b.tx.Exec(b.query+" "+placeHolders+b.suffix, b.args...)
+	b.rows = 0
+	b.args = b.args[:0]
+	return err
+}
+
+// CSV 取り込みで既存の id をどう扱うか
+const (
+	// importInsert 既存の id があればその行をエラーにする
+	importInsert = "insert"
+	// importUpsert 既存の id の行は updates の列を置き換え, ファイルにない行はそのまま残す
+	importUpsert = "upsert"
+	// importReplace upsert したうえでファイルにない行を消し, テーブルをファイルの内容にする
+	importReplace = "replace"
+)
+
+// importStatement mode に応じた INSERT 文と ON DUPLICATE KEY UPDATE 句を返す.
+// replace も REPLACE INTO は使わない. REPLACE は行を消して入れ直すので updates にない created_at が変わってしまう
+func importStatement(mode, table string, columns, updates []string) (string, string) {
+	query := fmt.Sprintf("INSERT INTO %s(%s) VALUES", table, strings.Join(columns, ", "))
+	if mode == importInsert {
+		return query, ""
+	}
+	sets := make([]string, len(updates))
+	for i, column := range updates {
+		sets[i] = fmt.Sprintf("%s = VALUES(%s)", column, column)
+	}
+	return query, " ON DUPLICATE KEY UPDATE " + strings.Join(sets, ", ")
+}
+
+// deleteMissing replace で取り込んだ ids にない行を table から消し, 消した行数を返す
+func deleteMissing(tx *sqlx.Tx, table string, ids []int64) (int64, error) {
+	query, args := "DELETE FROM "+table, []interface{}{}
+	if len(ids) > 0 {
+		var err error
+		query, args, err = sqlx.In(query+" WHERE id NOT IN (?)", ids)
+		if err != nil {
+			return 0, err
+		}
+	}
+	result, err := tx.Exec(query, args...)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"sort"
+	"sync"
+)
+
+// chairQuery searchChairs の検索条件. Range は未指定なら nil. 範囲と min, max の両方があれば両方を満たすものを返す
+type chairQuery struct {
+	PriceRange  *Range
+	HeightRange *Range
+	WidthRange  *Range
+	DepthRange  *Range
+	Price       bounds
+	Height      bounds
+	Width       bounds
+	Depth       bounds
+	Kinds       []string
+	Colors      []string
+	Features    []string
+}
+
+func newChairQuery() *chairQuery {
+	return &chairQuery{Price: noBounds(), Height: noBounds(), Width: noBounds(), Depth: noBounds()}
+}
+
+// HasCondition 絞り込み条件が 1 つ以上あるか
+func (q *chairQuery) HasCondition() bool {
+	return q.PriceRange != nil || q.HeightRange != nil || q.WidthRange != nil || q.DepthRange != nil ||
+		q.hasBounds() || len(q.Kinds) > 0 || len(q.Colors) > 0 || len(q.Features) > 0
+}
+
+func (q *chairQuery) hasBounds() bool {
+	return q.Price.isSet() || q.Height.isSet() || q.Width.isSet() || q.Depth.isSet()
+}
+
+// inBounds 椅子が min, max の条件をすべて満たすか
+func (q *chairQuery) inBounds(chair *Chair) bool {
+	return q.Price.contains(chair.Price) && q.Height.contains(chair.Height) &&
+		q.Width.contains(chair.Width) && q.Depth.contains(chair.Depth)
+}
+
+// chairOrders 検索で sort に指定できる並び順. 先頭が既定の並び順
+var chairOrders = []*searchOrder{
+	{Name: "popularity", Column: "popularity", Desc: true},
+	{Name: "price_asc", Column: "price"},
+	{Name: "price_desc", Column: "price", Desc: true},
+	{Name: "size_asc", Column: "size"},
+	{Name: "size_desc", Column: "size", Desc: true},
+	{Name: "newest", Column: "created_at", Desc: true},
+}
+
+// chairSortKey 並び順 o で比べる値. size は chair テーブルの生成列と同じく width * height * depth,
+// created_at は sortKeyExpr と同じくマイクロ秒
+func chairSortKey(o *searchOrder, chair *Chair) int64 {
+	switch o.Column {
+	case "popularity":
+		return chair.Popularity
+	case "price":
+		return chair.Price
+	case "size":
+		return chair.Width * chair.Height * chair.Depth
+	case "created_at":
+		return chair.CreatedAt.UnixMicro()
+	default:
+		return chair.ID
+	}
+}
+
+// chairIndex chair テーブルのオンメモリ転置インデックス
+type chairIndex struct {
+	M sync.RWMutex
+
+	// cond 範囲のバケットを作った検索条件
+	cond *ChairSearchCondition
+
+	chairs []*Chair
+	slotOf map[int64]int
+	// orders chairOrders の並び順ごとに並べたスロット
+	orders  map[string][]int
+	all     bitmap
+	inStock bitmap
+
+	price   rangeBuckets
+	height  rangeBuckets
+	width   rangeBuckets
+	depth   rangeBuckets
+	color   tokenIndex
+	kind    tokenIndex
+	feature tokenIndex
+}
+
+var chairIdx chairIndex
+
+func (x *chairIndex) Load(chairs []Chair) {
+	x.M.Lock()
+	defer x.M.Unlock()
+	x.chairs = make([]*Chair, 0, len(chairs))
+	x.slotOf = make(map[int64]int, len(chairs))
+	x.orders = make(map[string][]int, len(chairOrders))
+	for _, o := range chairOrders {
+		x.orders[o.Name] = make([]int, 0, len(chairs))
+	}
+	x.all = nil
+	x.inStock = nil
+	x.newRangeBuckets()
+	x.color = tokenIndex{}
+	x.kind = tokenIndex{}
+	x.feature = tokenIndex{}
+	for i := range chairs {
+		x.add(chairs[i])
+	}
+	x.sortOrders()
+	chairSearchCache.Clear()
+}
+
+// Put 椅子を追加する. 同じ id の椅子があれば置き換える
+func (x *chairIndex) Put(chairs []Chair) {
+	x.M.Lock()
+	defer x.M.Unlock()
+	// 変更前と変更後の行
+	changed := make([]interface{}, 0, 2*len(chairs))
+	for i := range chairs {
+		if slot, ok := x.slotOf[chairs[i].ID]; ok {
+			changed = append(changed, x.chairs[slot])
+		}
+		x.add(chairs[i])
+		changed = append(changed, &chairs[i])
+	}
+	chairSearchCache.Invalidate(changed...)
+	// 管理画面からの 1 件の更新で全体を並べ直さない
+	if len(chairs) == 1 {
+		x.reorder(x.slotOf[chairs[0].ID])
+		return
+	}
+	x.sortOrders()
+}
+
+func (x *chairIndex) add(chair Chair) {
+	slot, ok := x.slotOf[chair.ID]
+	if ok {
+		chair.CreatedAt = x.chairs[slot].CreatedAt
+		x.unindex(slot)
+		x.chairs[slot] = &chair
+	} else {
+		slot = len(x.chairs)
+		x.chairs = append(x.chairs, &chair)
+		x.slotOf[chair.ID] = slot
+		for name, order := range x.orders {
+			x.orders[name] = append(order, slot)
+		}
+	}
+	x.all.set(slot)
+	if chair.Stock > 0 {
+		x.inStock.set(slot)
+	}
+	x.addRanges(slot, &chair)
+	x.color.add(chair.Color, slot)
+	x.kind.add(chair.Kind, slot)
+	for _, f := range splitFeatures(chair.Features) {
+		x.feature.add(f, slot)
+	}
+}
+
+// SetCondition 範囲のバケットを cond で作り直す
+func (x *chairIndex) SetCondition(cond *ChairSearchCondition) {
+	x.M.Lock()
+	defer x.M.Unlock()
+	x.cond = cond
+	x.newRangeBuckets()
+	for slot, chair := range x.chairs {
+		if chair != nil {
+			x.addRanges(slot, chair)
+		}
+	}
+	chairSearchCache.Clear()
+}
+
+func (x *chairIndex) newRangeBuckets() {
+	x.price = newRangeBuckets(x.cond.Price)
+	x.height = newRangeBuckets(x.cond.Height)
+	x.width = newRangeBuckets(x.cond.Width)
+	x.depth = newRangeBuckets(x.cond.Depth)
+}
+
+func (x *chairIndex) addRanges(slot int, chair *Chair) {
+	x.price.add(x.cond.Price, slot, chair.Price)
+	x.height.add(x.cond.Height, slot, chair.Height)
+	x.width.add(x.cond.Width, slot, chair.Width)
+	x.depth.add(x.cond.Depth, slot, chair.Depth)
+}
+
+// unindex スロットをすべてのビットマップから外す
+func (x *chairIndex) unindex(slot int) {
+	chair := x.chairs[slot]
+	x.all.unset(slot)
+	x.inStock.unset(slot)
+	x.price.remove(slot)
+	x.height.remove(slot)
+	x.width.remove(slot)
+	x.depth.remove(slot)
+	x.color.remove(chair.Color, slot)
+	x.kind.remove(chair.Kind, slot)
+	for _, f := range splitFeatures(chair.Features) {
+		x.feature.remove(f, slot)
+	}
+}
+
+func (x *chairIndex) sortOrders() {
+	for _, o := range chairOrders {
+		o := o
+		order := x.orders[o.Name]
+		sort.Slice(order, func(i, j int) bool {
+			a, b := x.chairs[order[i]], x.chairs[order[j]]
+			return o.less(chairSortKey(o, a), a.ID, chairSortKey(o, b), b.ID)
+		})
+	}
+}
+
+// DecrStock UPDATE chair SET stock = stock - 1 WHERE id = ? AND stock > 0 と同じ更新をし, 残りの在庫数を返す.
+// 呼ぶ側は chairLocks で id の排他を取ったまま DB のコミットに続けて呼ぶ
+func (x *chairIndex) DecrStock(id int64) int64 {
+	x.M.Lock()
+	defer x.M.Unlock()
+	slot, ok := x.slotOf[id]
+	if !ok {
+		return 0
+	}
+	chair := x.chairs[slot]
+	before := *chair
+	if chair.Stock > 0 {
+		chair.Stock--
+	}
+	if chair.Stock <= 0 {
+		x.inStock.unset(slot)
+		// 在庫が残っている間は検索結果が変わらない
+		chairSearchCache.Invalidate(&before)
+	}
+	return chair.Stock
+}
+
+// reorder slot を各並び順から外し, 並びを保ったまま入れ直す
+func (x *chairIndex) reorder(slot int) {
+	chair := x.chairs[slot]
+	for _, o := range chairOrders {
+		order := removeSlot(x.orders[o.Name], slot)
+		key := chairSortKey(o, chair)
+		i := sort.Search(len(order), func(i int) bool {
+			v := x.chairs[order[i]]
+			return o.less(key, chair.ID, chairSortKey(o, v), v.ID)
+		})
+		x.orders[o.Name] = insertSlot(order, i, slot)
+	}
+}
+
+// Delete 椅子を外す. スロットは再利用せず nil のまま残す
+func (x *chairIndex) Delete(id int64) {
+	x.M.Lock()
+	defer x.M.Unlock()
+	slot, ok := x.slotOf[id]
+	if !ok {
+		return
+	}
+	x.unindex(slot)
+	chairSearchCache.Invalidate(x.chairs[slot])
+	x.chairs[slot] = nil
+	delete(x.slotOf, id)
+	for name, order := range x.orders {
+		x.orders[name] = removeSlot(order, slot)
+	}
+}
+
+func (x *chairIndex) Has(id int64) bool {
+	x.M.RLock()
+	defer x.M.RUnlock()
+	_, ok := x.slotOf[id]
+	return ok
+}
+
+// Export q に一致する椅子を売り切れも含めて id 順に返す
+func (x *chairIndex) Export(q *chairQuery) []Chair {
+	x.M.RLock()
+	defer x.M.RUnlock()
+
+	hits := x.filterFrom(x.all, q)
+	chairs := make([]Chair, 0, hits.count())
+	for slot, chair := range x.chairs {
+		if !hits.has(slot) {
+			continue
+		}
+		chairs = append(chairs, *chair)
+	}
+	sort.Slice(chairs, func(i, j int) bool { return chairs[i].ID < chairs[j].ID })
+	return chairs
+}
+
+// Search 条件に一致する椅子の件数と, 並び順 o で after (nil なら先頭) より後ろから offset 件飛ばした limit 件を返す.
+// 続きがあれば返した最後の行の位置を next として返す
+func (x *chairIndex) Search(q *chairQuery, o *searchOrder, after *searchCursor, offset, limit int) (int64, []Chair, *searchCursor) {
+	x.M.RLock()
+	defer x.M.RUnlock()
+
+	hits := x.filter(q)
+	count := hits.count()
+	chairs := []Chair{}
+	if offset < 0 || limit <= 0 {
+		return count, chairs, nil
+	}
+	order := x.orders[o.Name]
+	start := 0
+	if after != nil {
+		start = sort.Search(len(order), func(i int) bool {
+			chair := x.chairs[order[i]]
+			return o.less(after.Key, after.ID, chairSortKey(o, chair), chair.ID)
+		})
+	}
+	for _, slot := range order[start:] {
+		if !hits.has(slot) {
+			continue
+		}
+		if offset > 0 {
+			offset--
+			continue
+		}
+		if len(chairs) >= limit {
+			last := chairs[len(chairs)-1]
+			return count, chairs, &searchCursor{Order: o.Name, Key: chairSortKey(o, &last), ID: last.ID}
+		}
+		chairs = append(chairs, *x.chairs[slot])
+	}
+	return count, chairs, nil
+}
+
+// Facets 条件に一致する在庫ありの椅子を検索条件の選択肢ごとに数える.
+// 範囲と kind, color はその次元の選択を外して数え, 別の選択肢に切り替えたときの件数にする
+func (x *chairIndex) Facets(q *chairQuery) ChairFacets {
+	x.M.RLock()
+	defer x.M.RUnlock()
+
+	without := func(clear func(q *chairQuery)) bitmap {
+		other := *q
+		clear(&other)
+		return x.filter(&other)
+	}
+	return ChairFacets{
+		Price:   x.price.counts(without(func(q *chairQuery) { q.PriceRange = nil })),
+		Height:  x.height.counts(without(func(q *chairQuery) { q.HeightRange = nil })),
+		Width:   x.width.counts(without(func(q *chairQuery) { q.WidthRange = nil })),
+		Depth:   x.depth.counts(without(func(q *chairQuery) { q.DepthRange = nil })),
+		Color:   x.color.counts(without(func(q *chairQuery) { q.Colors = nil }), x.cond.Color.List),
+		Kind:    x.kind.counts(without(func(q *chairQuery) { q.Kinds = nil }), x.cond.Kind.List),
+		Feature: x.feature.counts(x.filter(q), x.cond.Feature.List),
+	}
+}
+
+// filter 検索の対象は在庫ありの椅子だけ
+func (x *chairIndex) filter(q *chairQuery) bitmap {
+	return x.filterFrom(x.inStock, q)
+}
+
+// filterFrom base のうち q に一致するスロット
+func (x *chairIndex) filterFrom(base bitmap, q *chairQuery) bitmap {
+	hits := base.clone()
+	filterRange(hits, x.price, x.cond.Price, q.PriceRange, func(slot int) int64 { return x.chairs[slot].Price })
+	filterRange(hits, x.height, x.cond.Height, q.HeightRange, func(slot int) int64 { return x.chairs[slot].Height })
+	filterRange(hits, x.width, x.cond.Width, q.WidthRange, func(slot int) int64 { return x.chairs[slot].Width })
+	filterRange(hits, x.depth, x.cond.Depth, q.DepthRange, func(slot int) int64 { return x.chairs[slot].Depth })
+	if len(q.Kinds) > 0 {
+		hits.and(x.kind.any(q.Kinds))
+	}
+	if len(q.Colors) > 0 {
+		hits.and(x.color.any(q.Colors))
+	}
+	for _, f := range q.Features {
+		hits.and(x.feature[f])
+	}
+	// min, max はバケットがないので絞り込んだ残りを 1 件ずつ見る
+	if q.hasBounds() {
+		hits.keep(func(slot int) bool { return q.inBounds(x.chairs[slot]) })
+	}
+	return hits
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"math/rand"
+	"sort"
+	"testing"
+	"time"
+)
+
+func randomChairs(rnd *rand.Rand, n int) []Chair {
+	kinds := []string{"a", "b", "c"}
+	chairs := make([]Chair, n)
+	for i := range chairs {
+		chairs[i] = Chair{
+			ID:         int64(i + 1),
+			Price:      int64(rnd.Intn(300)),
+			Height:     int64(rnd.Intn(5) + 1),
+			Width:      int64(rnd.Intn(5) + 1),
+			Depth:      int64(rnd.Intn(5) + 1),
+			Kind:       kinds[rnd.Intn(len(kinds))],
+			Popularity: int64(rnd.Intn(10)),
+			Stock:      int64(rnd.Intn(3)),
+			CreatedAt:  time.Unix(int64(rnd.Intn(20)), 0),
+		}
+	}
+	return chairs
+}
+
+func newTestChairIndex(chairs []Chair) *chairIndex {
+	x := &chairIndex{}
+	x.SetCondition(&ChairSearchCondition{
+		Price: RangeCondition{Ranges: []*Range{{ID: 0, Min: -1, Max: 100}, {ID: 1, Min: 100, Max: 200}, {ID: 2, Min: 200, Max: -1}}},
+		Kind:  ListCondition{List: []string{"a", "b", "c"}},
+	})
+	x.Load(chairs)
+	return x
+}
+
+// bruteForce q に一致する椅子をすべて並び順 o で並べる
+func bruteForce(chairs []Chair, q *chairQuery, o *searchOrder) []Chair {
+	hits := []Chair{}
+	for i := range chairs {
+		if q.Match(&chairs[i]) {
+			hits = append(hits, chairs[i])
+		}
+	}
+	sort.Slice(hits, func(i, j int) bool {
+		return o.less(chairSortKey(o, &hits[i]), hits[i].ID, chairSortKey(o, &hits[j]), hits[j].ID)
+	})
+	return hits
+}
+
+func sameIDs(a, b []Chair) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].ID != b[i].ID {
+			return false
+		}
+	}
+	return true
+}
+
+// TestChairSearchPaging 条件を変えながらカーソルとページ番号で辿った結果を総当たりで並べた結果と比べる
+func TestChairSearchPaging(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	chairs := randomChairs(rnd, 300)
+	x := newTestChairIndex(chairs)
+	for round := 0; round < 50; round++ {
+		q := newChairQuery()
+		if rnd.Intn(2) == 0 {
+			q.PriceRange = x.cond.Price.Ranges[rnd.Intn(3)]
+		}
+		if rnd.Intn(2) == 0 {
+			q.Kinds = []string{"a", "c"}[:rnd.Intn(2)+1]
+		}
+		if rnd.Intn(2) == 0 {
+			q.Height = bounds{Min: 2, Max: 4}
+		}
+		for _, o := range chairOrders {
+			want := bruteForce(chairs, q, o)
+			perPage := rnd.Intn(20) + 1
+
+			count, _, _ := x.Search(q, o, nil, 0, perPage)
+			if count != int64(len(want)) {
+				t.Fatalf("%s: count %d, want %d", o.Name, count, len(want))
+			}
+
+			got := []Chair{}
+			var after *searchCursor
+			for {
+				_, page, next := x.Search(q, o, after, 0, perPage)
+				got = append(got, page...)
+				if next == nil {
+					break
+				}
+				var err error
+				if after, err = decodeSearchCursor(next.Encode()); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if !sameIDs(got, want) {
+				t.Fatalf("%s: cursor paging got %v, want %v", o.Name, got, want)
+			}
+
+			got = got[:0]
+			for page := 0; page*perPage < len(want); page++ {
+				_, chairs, _ := x.Search(q, o, nil, page*perPage, perPage)
+				got = append(got, chairs...)
+			}
+			if !sameIDs(got, want) {
+				t.Fatalf("%s: offset paging got %v, want %v", o.Name, got, want)
+			}
+		}
+	}
+}
+
+// TestChairIndexPut 1 件ずつの Put と Delete の後の並びが作り直したインデックスと同じか
+func TestChairIndexPut(t *testing.T) {
+	rnd := rand.New(rand.NewSource(2))
+	chairs := randomChairs(rnd, 100)
+	x := newTestChairIndex(chairs)
+	rows := map[int64]Chair{}
+	for _, chair := range chairs {
+		rows[chair.ID] = chair
+	}
+	for step := 0; step < 300; step++ {
+		chair := randomChairs(rnd, 1)[0]
+		chair.ID = int64(rnd.Intn(120) + 1)
+		if rnd.Intn(5) == 0 {
+			x.Delete(chair.ID)
+			delete(rows, chair.ID)
+			continue
+		}
+		if old, ok := rows[chair.ID]; ok {
+			chair.CreatedAt = old.CreatedAt
+		}
+		x.Put([]Chair{chair})
+		rows[chair.ID] = chair
+	}
+
+	all := make([]Chair, 0, len(rows))
+	for _, chair := range rows {
+		all = append(all, chair)
+	}
+	y := newTestChairIndex(all)
+	for _, o := range chairOrders {
+		_, got, _ := x.Search(newChairQuery(), o, nil, 0, len(all))
+		_, want, _ := y.Search(newChairQuery(), o, nil, 0, len(all))
+		if !sameIDs(got, want) {
+			t.Fatalf("%s: got %v, want %v", o.Name, got, want)
+		}
+	}
+	if got := x.Export(newChairQuery()); len(got) != len(all) {
+		t.Fatalf("export: got %d chairs, want %d", len(got), len(all))
+	}
+}
+
+func TestChairIndexExportIncludesSoldOut(t *testing.T) {
+	x := newTestChairIndex([]Chair{{ID: 1, Kind: "a"}, {ID: 2, Kind: "a", Stock: 1}, {ID: 3, Kind: "b"}})
+	q := newChairQuery()
+	if got := x.Export(q); len(got) != 3 {
+		t.Fatalf("got %v", got)
+	}
+	q.Kinds = []string{"a"}
+	if got := x.Export(q); len(got) != 2 {
+		t.Fatalf("got %v with kind filter", got)
+	}
+}
+
+func TestChairIndexPutKeepsCreatedAt(t *testing.T) {
+	x := newTestChairIndex([]Chair{{ID: 1, Stock: 1, CreatedAt: time.Unix(5, 0)}, {ID: 2, Stock: 1, CreatedAt: time.Unix(10, 0)}})
+	x.Put([]Chair{{ID: 1, Stock: 1, CreatedAt: time.Unix(50, 0)}})
+	o, _ := findOrder(chairOrders, "newest")
+	_, got, _ := x.Search(newChairQuery(), o, nil, 0, 2)
+	if got[0].ID != 2 || !got[1].CreatedAt.Equal(time.Unix(5, 0)) {
+		t.Fatalf("got %v", got)
+	}
+}
+
+func TestChairIndexFacets(t *testing.T) {
+	x := newTestChairIndex([]Chair{
+		{ID: 1, Kind: "a", Price: 10, Stock: 1},
+		{ID: 2, Kind: "b", Price: 150, Stock: 1},
+		{ID: 3, Kind: "a", Price: 250, Stock: 1},
+		{ID: 4, Kind: "a", Price: 260},
+	})
+	q := newChairQuery()
+	q.PriceRange = x.cond.Price.Ranges[2]
+	q.Kinds = []string{"a"}
+	f := x.Facets(q)
+	if f.Price[0] != 1 || f.Price[1] != 0 || f.Price[2] != 1 {
+		t.Fatalf("price facets %v", f.Price)
+	}
+	if f.Kind["a"] != 1 || f.Kind["b"] != 0 || f.Kind["c"] != 0 {
+		t.Fatalf("kind facets %v", f.Kind)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+)
+
+// encodeRecord RecordMapper.Decode の逆. columns の列名と db タグが一致するフィールドを並べる
+func encodeRecord(columns []string, src interface{}) []string {
+	v := reflect.ValueOf(src)
+	fields := recordFields(v.Type())
+	record := make([]string, len(columns))
+	for i, column := range columns {
+		f, ok := fields[column]
+		if !ok {
+			continue
+		}
+		switch field := v.Field(f); field.Kind() {
+		case reflect.Int64:
+			record[i] = strconv.FormatInt(field.Int(), 10)
+		case reflect.Float64:
+			record[i] = strconv.FormatFloat(field.Float(), 'f', -1, 64)
+		case reflect.String:
+			record[i] = field.String()
+		}
+	}
+	return record
+}
+
+// writeCSV row(0) から row(n-1) までを columns の並びの CSV としてストリームで返す
+func writeCSV(c echo.Context, filename string, columns []string, header bool, n int, row func(i int) interface{}) error {
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, "text/csv; charset=UTF-8")
+	res.Header().Set(echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=%q", filename))
+	res.WriteHeader(http.StatusOK)
+
+	w := csv.NewWriter(res)
+	if header {
+		if err := w.Write(columns); err != nil {
+			return err
+		}
+	}
+	for i := 0; i < n; i++ {
+		if err := w.Write(encodeRecord(columns, row(i))); err != nil {
+			return err
+		}
+		if i%1000 == 999 {
+			w.Flush()
+			res.Flush()
+		}
+	}
+	w.Flush()
+	return w.Error()
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// csvReportMaxErrors CSV 取り込みのレポートに載せるエラーの最大件数
+const csvReportMaxErrors = 1000
+
+var chairCSVColumns = []string{"id", "name", "description", "thumbnail", "price", "height", "width", "depth", "color", "features", "kind", "popularity", "stock"}
+var estateCSVColumns = []string{"id", "name", "description", "thumbnail", "address", "latitude", "longitude", "rent", "door_height", "door_width", "features", "popularity"}
+
+// CSVRowError CSV の 1 値分の検証エラー. Row は 1 始まりのレコード番号
+type CSVRowError struct {
+	Row    int    `json:"row"`
+	Column string `json:"column"`
+	Value  string `json:"value"`
+	Reason string `json:"reason"`
+}
+
+// CSVImportReport POST /api/chair, /api/estate のレスポンス. Deleted は mode=replace でファイルになかったため消した行数
+type CSVImportReport struct {
+	Valid    int           `json:"valid"`
+	Invalid  int           `json:"invalid"`
+	Imported int           `json:"imported"`
+	Deleted  int64         `json:"deleted"`
+	Errors   []CSVRowError `json:"errors"`
+}
+
+func newCSVImportReport() *CSVImportReport {
+	return &CSVImportReport{Errors: []CSVRowError{}}
+}
+
+func (r *CSVImportReport) Add(row int, errs []*RecordError) {
+	r.Invalid++
+	for _, err := range errs {
+		if len(r.Errors) >= csvReportMaxErrors {
+			return
+		}
+		r.Errors = append(r.Errors, CSVRowError{Row: row, Column: err.Column, Value: err.Value, Reason: err.Reason})
+	}
+}
+
+// normalizeCSVHeader ヘッダ行の列名から空白と BOM を取り除く
+func normalizeCSVHeader(record []string) []string {
+	columns := make([]string, len(record))
+	for i, name := range record {
+		columns[i] = strings.TrimSpace(strings.TrimPrefix(name, "\ufeff"))
+	}
+	return columns
+}
+
+// checkCSVHeader ヘッダ行に未知の列, 重複した列, 足りない列がないかを検証する
+func checkCSVHeader(header, columns []string) []*RecordError {
+	errs := make([]*RecordError, 0)
+	known := make(map[string]bool, len(columns))
+	for _, column := range columns {
+		known[column] = true
+	}
+	found := make(map[string]bool, len(header))
+	for _, name := range header {
+		if !known[name] {
+			errs = append(errs, &RecordError{Column: name, Value: name, Reason: "unknown column"})
+		} else if found[name] {
+			errs = append(errs, &RecordError{Column: name, Value: name, Reason: "duplicate column"})
+		}
+		found[name] = true
+	}
+	for _, column := range columns {
+		if !found[column] {
+			errs = append(errs, &RecordError{Column: column, Reason: "missing column"})
+		}
+	}
+	return errs
+}
+
+// カラムの型で入る値の範囲
+const (
+	maxTinyIntUnsigned  = 255
+	maxSmallIntUnsigned = 65535
+	maxMediumInt        = 8388607
+)
+
+type recordChecker struct {
+	errs []*RecordError
+}
+
+func (rc *recordChecker) id(id int64, seen map[int64]bool, exists bool) {
+	if seen[id] {
+		rc.errs = append(rc.errs, &RecordError{Column: "id", Value: strconv.FormatInt(id, 10), Reason: "duplicate id in file"})
+	} else if exists {
+		rc.errs = append(rc.errs, &RecordError{Column: "id", Value: strconv.FormatInt(id, 10), Reason: "id already exists"})
+	}
+}
+
+func (rc *recordChecker) intRange(column string, v, min, max int64) {
+	if v < min || max < v {
+		rc.errs = append(rc.errs, &RecordError{Column: column, Value: strconv.FormatInt(v, 10), Reason: "out of range"})
+	}
+}
+
+func (rc *recordChecker) floatRange(column string, v, min, max float64) {
+	if v < min || max < v {
+		rc.errs = append(rc.errs, &RecordError{Column: column, Value: strconv.FormatFloat(v, 'f', -1, 64), Reason: "out of range"})
+	}
+}
+
+func (rc *recordChecker) length(column, s string, max int) {
+	if utf8.RuneCountInString(s) > max {
+		rc.errs = append(rc.errs, &RecordError{Column: column, Value: s, Reason: "too long"})
+	}
+}
+
+// validateChair chair テーブルに入らない値や重複した id を検出する. 既存の id は insert のときだけエラーにする
+func validateChair(chair Chair, seen map[int64]bool, mode string) []*RecordError {
+	rc := recordChecker{}
+	rc.intRange("id", chair.ID, 0, maxSmallIntUnsigned)
+	rc.id(chair.ID, seen, mode == importInsert && chairIdx.Has(chair.ID))
+	rc.length("name", chair.Name, 64)
+	rc.length("description", chair.Description, 128)
+	rc.length("thumbnail", chair.Thumbnail, 128)
+	rc.intRange("price", chair.Price, 0, maxSmallIntUnsigned)
+	rc.intRange("height", chair.Height, 0, maxTinyIntUnsigned)
+	rc.intRange("width", chair.Width, 0, maxTinyIntUnsigned)
+	rc.intRange("depth", chair.Depth, 0, maxTinyIntUnsigned)
+	rc.length("color", chair.Color, 64)
+	rc.length("features", chair.Features, 64)
+	rc.length("kind", chair.Kind, 64)
+	rc.intRange("popularity", chair.Popularity, 0, maxMediumInt)
+	rc.intRange("stock", chair.Stock, 0, maxTinyIntUnsigned)
+	return rc.errs
+}
+
+// validateEstate estate テーブルに入らない値や重複した id, 範囲外の緯度経度を検出する. 既存の id は insert のときだけエラーにする
+func validateEstate(estate Estate, seen map[int64]bool, mode string) []*RecordError {
+	rc := recordChecker{}
+	rc.intRange("id", estate.ID, 0, maxSmallIntUnsigned)
+	rc.id(estate.ID, seen, mode == importInsert && estateIdx.Has(estate.ID))
+	rc.length("name", estate.Name, 32)
+	rc.length("description", estate.Description, 128)
+	rc.length("thumbnail", estate.Thumbnail, 128)
+	rc.length("address", estate.Address, 128)
+	rc.floatRange("latitude", estate.Latitude, -90, 90)
+	rc.floatRange("longitude", estate.Longitude, -180, 180)
+	rc.intRange("rent", estate.Rent, 0, maxMediumInt)
+	rc.intRange("door_height", estate.DoorHeight, 0, maxTinyIntUnsigned)
+	rc.intRange("door_width", estate.DoorWidth, 0, maxTinyIntUnsigned)
+	rc.length("features", estate.Features, 64)
+	rc.intRange("popularity", estate.Popularity, 0, maxMediumInt)
+	return rc.errs
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestValidateChair(t *testing.T) {
+	chair := Chair{ID: 1, Name: "椅子", Price: 100, Height: 10, Width: 10, Depth: 10, Kind: "a", Stock: 1}
+	if errs := validateChair(chair, map[int64]bool{}, importInsert); len(errs) > 0 {
+		t.Fatalf("valid chair: %v", errs[0])
+	}
+	if errs := validateChair(chair, map[int64]bool{1: true}, importInsert); len(errs) != 1 || errs[0].Reason != "duplicate id in file" {
+		t.Fatalf("duplicate id: %v", errs)
+	}
+
+	bad := chair
+	bad.Price = maxSmallIntUnsigned + 1
+	bad.Stock = -1
+	bad.Name = strings.Repeat("あ", 65)
+	errs := validateChair(bad, map[int64]bool{}, importInsert)
+	columns := []string{}
+	for _, err := range errs {
+		columns = append(columns, err.Column)
+	}
+	if strings.Join(columns, ",") != "name,price,stock" {
+		t.Fatalf("got errors in %v", columns)
+	}
+}
+
+func TestValidateEstate(t *testing.T) {
+	estate := Estate{ID: 1, Name: "物件", Latitude: 35, Longitude: 139, Rent: 1000, DoorHeight: 10, DoorWidth: 10}
+	if errs := validateEstate(estate, map[int64]bool{}, importInsert); len(errs) > 0 {
+		t.Fatalf("valid estate: %v", errs[0])
+	}
+	estate.Latitude = 91
+	estate.Longitude = -181
+	if errs := validateEstate(estate, map[int64]bool{}, importInsert); len(errs) != 2 {
+		t.Fatalf("got %v", errs)
+	}
+}
+
+func TestCSVImportReportLimitsErrors(t *testing.T) {
+	report := newCSVImportReport()
+	for row := 1; row <= csvReportMaxErrors+1; row++ {
+		report.Add(row, []*RecordError{{Column: "id", Reason: "not an integer"}})
+	}
+	if report.Invalid != csvReportMaxErrors+1 || len(report.Errors) != csvReportMaxErrors {
+		t.Fatalf("invalid %d, errors %d", report.Invalid, len(report.Errors))
+	}
+}
+
+func TestCheckCSVHeader(t *testing.T) {
+	header := normalizeCSVHeader([]string{"\ufeffstock", " id ", "name", "description", "thumbnail", "price", "height", "width", "depth", "color", "features", "kind", "popularity"})
+	if errs := checkCSVHeader(header, chairCSVColumns); len(errs) > 0 {
+		t.Fatalf("reordered header: %v", errs[0])
+	}
+	errs := checkCSVHeader([]string{"id", "id", "size"}, []string{"id", "name"})
+	reasons := []string{}
+	for _, err := range errs {
+		reasons = append(reasons, err.Column+" "+err.Reason)
+	}
+	if strings.Join(reasons, ",") != "id duplicate column,size unknown column,name missing column" {
+		t.Fatalf("got %v", reasons)
+	}
+}
+
+func TestRecordMapperDecode(t *testing.T) {
+	rm := RecordMapper{Record: []string{"3", "x", "10", "a,b"}, Columns: []string{"stock", "kind", "price", "features"}}
+	var chair Chair
+	rm.Decode(&chair)
+	if err := rm.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if chair.Stock != 3 || chair.Kind != "x" || chair.Price != 10 || chair.Features != "a,b" {
+		t.Fatalf("got %+v", chair)
+	}
+
+	for _, c := range []struct {
+		record []string
+		reason string
+	}{
+		{[]string{"3", "x"}, "too few columns"},
+		{[]string{"3", "x", "10", "a", "extra"}, "too many columns"},
+		{[]string{"many", "x", "10", "a"}, "not an integer"},
+	} {
+		rm := RecordMapper{Record: c.record, Columns: []string{"stock", "kind", "price", "features"}}
+		rm.Decode(&Chair{})
+		if err, ok := rm.Err().(*RecordError); !ok || err.Reason != c.reason {
+			t.Fatalf("%v: got %v, want %s", c.record, rm.Err(), c.reason)
+		}
+	}
+}
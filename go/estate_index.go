@@ -0,0 +1,323 @@
+package main
+
+import (
+	"sort"
+	"sync"
+)
+
+// estateQuery searchEstates の検索条件. Range は未指定なら nil. 範囲と min, max の両方があれば両方を満たすものを返す
+type estateQuery struct {
+	DoorHeightRange *Range
+	DoorWidthRange  *Range
+	RentRange       *Range
+	DoorHeight      bounds
+	DoorWidth       bounds
+	Rent            bounds
+	Features        []string
+}
+
+func newEstateQuery() *estateQuery {
+	return &estateQuery{DoorHeight: noBounds(), DoorWidth: noBounds(), Rent: noBounds()}
+}
+
+// HasCondition 絞り込み条件が 1 つ以上あるか
+func (q *estateQuery) HasCondition() bool {
+	return q.DoorHeightRange != nil || q.DoorWidthRange != nil || q.RentRange != nil || q.hasBounds() || len(q.Features) > 0
+}
+
+func (q *estateQuery) hasBounds() bool {
+	return q.DoorHeight.isSet() || q.DoorWidth.isSet() || q.Rent.isSet()
+}
+
+// inBounds 物件が min, max の条件をすべて満たすか
+func (q *estateQuery) inBounds(estate *Estate) bool {
+	return q.DoorHeight.contains(estate.DoorHeight) && q.DoorWidth.contains(estate.DoorWidth) && q.Rent.contains(estate.Rent)
+}
+
+// estateOrders 検索で sort に指定できる並び順. 先頭が既定の並び順
+var estateOrders = []*searchOrder{
+	{Name: "popularity", Column: "popularity", Desc: true},
+	{Name: "rent_asc", Column: "rent"},
+	{Name: "rent_desc", Column: "rent", Desc: true},
+	{Name: "size_asc", Column: "door_area"},
+	{Name: "size_desc", Column: "door_area", Desc: true},
+	{Name: "newest", Column: "created_at", Desc: true},
+}
+
+// estateSortKey 並び順 o で比べる値. door_area は estate テーブルの生成列と同じく door_width * door_height,
+// created_at は sortKeyExpr と同じくマイクロ秒
+func estateSortKey(o *searchOrder, estate *Estate) int64 {
+	switch o.Column {
+	case "popularity":
+		return estate.Popularity
+	case "rent":
+		return estate.Rent
+	case "door_area":
+		return estate.DoorWidth * estate.DoorHeight
+	case "created_at":
+		return estate.CreatedAt.UnixMicro()
+	default:
+		return estate.ID
+	}
+}
+
+// estateIndex estate テーブルのオンメモリ転置インデックス
+type estateIndex struct {
+	M sync.RWMutex
+
+	// cond 範囲のバケットを作った検索条件
+	cond *EstateSearchCondition
+
+	estates []*Estate
+	slotOf  map[int64]int
+	// orders estateOrders の並び順ごとに並べたスロット
+	orders map[string][]int
+	all    bitmap
+
+	doorHeight rangeBuckets
+	doorWidth  rangeBuckets
+	rent       rangeBuckets
+	feature    tokenIndex
+}
+
+var estateIdx estateIndex
+
+func (x *estateIndex) Load(estates []Estate) {
+	x.M.Lock()
+	defer x.M.Unlock()
+	x.estates = make([]*Estate, 0, len(estates))
+	x.slotOf = make(map[int64]int, len(estates))
+	x.orders = make(map[string][]int, len(estateOrders))
+	for _, o := range estateOrders {
+		x.orders[o.Name] = make([]int, 0, len(estates))
+	}
+	x.all = nil
+	x.newRangeBuckets()
+	x.feature = tokenIndex{}
+	for i := range estates {
+		x.add(estates[i])
+	}
+	x.sortOrders()
+	estateSearchCache.Clear()
+}
+
+// Put 物件を追加する. 同じ id の物件があれば置き換える
+func (x *estateIndex) Put(estates []Estate) {
+	x.M.Lock()
+	defer x.M.Unlock()
+	// 変更前と変更後の行
+	changed := make([]interface{}, 0, 2*len(estates))
+	for i := range estates {
+		if slot, ok := x.slotOf[estates[i].ID]; ok {
+			changed = append(changed, x.estates[slot])
+		}
+		x.add(estates[i])
+		changed = append(changed, &estates[i])
+	}
+	estateSearchCache.Invalidate(changed...)
+	// 管理画面からの 1 件の更新で全体を並べ直さない
+	if len(estates) == 1 {
+		x.reorder(x.slotOf[estates[0].ID])
+		return
+	}
+	x.sortOrders()
+}
+
+func (x *estateIndex) add(estate Estate) {
+	slot, ok := x.slotOf[estate.ID]
+	if ok {
+		estate.CreatedAt = x.estates[slot].CreatedAt
+		x.unindex(slot)
+		x.estates[slot] = &estate
+	} else {
+		slot = len(x.estates)
+		x.estates = append(x.estates, &estate)
+		x.slotOf[estate.ID] = slot
+		for name, order := range x.orders {
+			x.orders[name] = append(order, slot)
+		}
+	}
+	x.all.set(slot)
+	x.addRanges(slot, &estate)
+	for _, f := range splitFeatures(estate.Features) {
+		x.feature.add(f, slot)
+	}
+}
+
+// SetCondition 範囲のバケットを cond で作り直す
+func (x *estateIndex) SetCondition(cond *EstateSearchCondition) {
+	x.M.Lock()
+	defer x.M.Unlock()
+	x.cond = cond
+	x.newRangeBuckets()
+	for slot, estate := range x.estates {
+		if estate != nil {
+			x.addRanges(slot, estate)
+		}
+	}
+	estateSearchCache.Clear()
+}
+
+func (x *estateIndex) newRangeBuckets() {
+	x.doorHeight = newRangeBuckets(x.cond.DoorHeight)
+	x.doorWidth = newRangeBuckets(x.cond.DoorWidth)
+	x.rent = newRangeBuckets(x.cond.Rent)
+}
+
+func (x *estateIndex) addRanges(slot int, estate *Estate) {
+	x.doorHeight.add(x.cond.DoorHeight, slot, estate.DoorHeight)
+	x.doorWidth.add(x.cond.DoorWidth, slot, estate.DoorWidth)
+	x.rent.add(x.cond.Rent, slot, estate.Rent)
+}
+
+// unindex スロットをすべてのビットマップから外す
+func (x *estateIndex) unindex(slot int) {
+	estate := x.estates[slot]
+	x.all.unset(slot)
+	x.doorHeight.remove(slot)
+	x.doorWidth.remove(slot)
+	x.rent.remove(slot)
+	for _, f := range splitFeatures(estate.Features) {
+		x.feature.remove(f, slot)
+	}
+}
+
+func (x *estateIndex) sortOrders() {
+	for _, o := range estateOrders {
+		o := o
+		order := x.orders[o.Name]
+		sort.Slice(order, func(i, j int) bool {
+			a, b := x.estates[order[i]], x.estates[order[j]]
+			return o.less(estateSortKey(o, a), a.ID, estateSortKey(o, b), b.ID)
+		})
+	}
+}
+
+// reorder slot を各並び順から外し, 並びを保ったまま入れ直す
+func (x *estateIndex) reorder(slot int) {
+	estate := x.estates[slot]
+	for _, o := range estateOrders {
+		order := removeSlot(x.orders[o.Name], slot)
+		key := estateSortKey(o, estate)
+		i := sort.Search(len(order), func(i int) bool {
+			v := x.estates[order[i]]
+			return o.less(key, estate.ID, estateSortKey(o, v), v.ID)
+		})
+		x.orders[o.Name] = insertSlot(order, i, slot)
+	}
+}
+
+// Delete 物件を外す. スロットは再利用せず nil のまま残す
+func (x *estateIndex) Delete(id int64) {
+	x.M.Lock()
+	defer x.M.Unlock()
+	slot, ok := x.slotOf[id]
+	if !ok {
+		return
+	}
+	x.unindex(slot)
+	estateSearchCache.Invalidate(x.estates[slot])
+	x.estates[slot] = nil
+	delete(x.slotOf, id)
+	for name, order := range x.orders {
+		x.orders[name] = removeSlot(order, slot)
+	}
+}
+
+func (x *estateIndex) Has(id int64) bool {
+	x.M.RLock()
+	defer x.M.RUnlock()
+	_, ok := x.slotOf[id]
+	return ok
+}
+
+// Export q に一致する物件を id 順に返す. q が条件を持たなければすべての物件を返す
+func (x *estateIndex) Export(q *estateQuery) []Estate {
+	x.M.RLock()
+	defer x.M.RUnlock()
+
+	var hits bitmap
+	if q.HasCondition() {
+		hits = x.filter(q)
+	}
+	estates := make([]Estate, 0, len(x.estates))
+	for slot, estate := range x.estates {
+		if estate == nil || (hits != nil && !hits.has(slot)) {
+			continue
+		}
+		estates = append(estates, *estate)
+	}
+	sort.Slice(estates, func(i, j int) bool { return estates[i].ID < estates[j].ID })
+	return estates
+}
+
+// Search 条件に一致する物件の件数と, 並び順 o で after (nil なら先頭) より後ろから offset 件飛ばした limit 件を返す.
+// 続きがあれば返した最後の行の位置を next として返す
+func (x *estateIndex) Search(q *estateQuery, o *searchOrder, after *searchCursor, offset, limit int) (int64, []Estate, *searchCursor) {
+	x.M.RLock()
+	defer x.M.RUnlock()
+
+	hits := x.filter(q)
+	count := hits.count()
+	estates := []Estate{}
+	if offset < 0 || limit <= 0 {
+		return count, estates, nil
+	}
+	order := x.orders[o.Name]
+	start := 0
+	if after != nil {
+		start = sort.Search(len(order), func(i int) bool {
+			estate := x.estates[order[i]]
+			return o.less(after.Key, after.ID, estateSortKey(o, estate), estate.ID)
+		})
+	}
+	for _, slot := range order[start:] {
+		if !hits.has(slot) {
+			continue
+		}
+		if offset > 0 {
+			offset--
+			continue
+		}
+		if len(estates) >= limit {
+			last := estates[len(estates)-1]
+			return count, estates, &searchCursor{Order: o.Name, Key: estateSortKey(o, &last), ID: last.ID}
+		}
+		estates = append(estates, *x.estates[slot])
+	}
+	return count, estates, nil
+}
+
+// Facets 条件に一致する物件を検索条件の選択肢ごとに数える.
+// 範囲はその次元の選択を外して数え, 別の範囲に切り替えたときの件数にする
+func (x *estateIndex) Facets(q *estateQuery) EstateFacets {
+	x.M.RLock()
+	defer x.M.RUnlock()
+
+	without := func(clear func(q *estateQuery)) bitmap {
+		other := *q
+		clear(&other)
+		return x.filter(&other)
+	}
+	return EstateFacets{
+		DoorHeight: x.doorHeight.counts(without(func(q *estateQuery) { q.DoorHeightRange = nil })),
+		DoorWidth:  x.doorWidth.counts(without(func(q *estateQuery) { q.DoorWidthRange = nil })),
+		Rent:       x.rent.counts(without(func(q *estateQuery) { q.RentRange = nil })),
+		Feature:    x.feature.counts(x.filter(q), x.cond.Feature.List),
+	}
+}
+
+func (x *estateIndex) filter(q *estateQuery) bitmap {
+	hits := x.all.clone()
+	filterRange(hits, x.doorHeight, x.cond.DoorHeight, q.DoorHeightRange, func(slot int) int64 { return x.estates[slot].DoorHeight })
+	filterRange(hits, x.doorWidth, x.cond.DoorWidth, q.DoorWidthRange, func(slot int) int64 { return x.estates[slot].DoorWidth })
+	filterRange(hits, x.rent, x.cond.Rent, q.RentRange, func(slot int) int64 { return x.estates[slot].Rent })
+	for _, f := range q.Features {
+		hits.and(x.feature[f])
+	}
+	// min, max はバケットがないので絞り込んだ残りを 1 件ずつ見る
+	if q.hasBounds() {
+		hits.keep(func(slot int) bool { return q.inBounds(x.estates[slot]) })
+	}
+	return hits
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"math/rand"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func randomEstates(rnd *rand.Rand, n int) []Estate {
+	features := []string{"", "a", "b", "a,b", "b,c", "a,b,c"}
+	estates := make([]Estate, n)
+	for i := range estates {
+		estates[i] = Estate{
+			ID:         int64(i + 1),
+			Rent:       int64(rnd.Intn(300)),
+			DoorHeight: int64(rnd.Intn(5) + 1),
+			DoorWidth:  int64(rnd.Intn(5) + 1),
+			Features:   features[rnd.Intn(len(features))],
+			Popularity: int64(rnd.Intn(10)),
+			CreatedAt:  time.Unix(int64(rnd.Intn(20)), 0),
+		}
+	}
+	return estates
+}
+
+func newTestEstateIndex(estates []Estate) *estateIndex {
+	x := &estateIndex{}
+	x.SetCondition(&EstateSearchCondition{
+		DoorHeight: RangeCondition{Ranges: []*Range{{ID: 0, Min: -1, Max: 3}, {ID: 1, Min: 3, Max: -1}}},
+		DoorWidth:  RangeCondition{Ranges: []*Range{{ID: 0, Min: -1, Max: 3}, {ID: 1, Min: 3, Max: -1}}},
+		Rent:       RangeCondition{Ranges: []*Range{{ID: 0, Min: -1, Max: 100}, {ID: 1, Min: 100, Max: 200}, {ID: 2, Min: 200, Max: -1}}},
+		Feature:    ListCondition{List: []string{"a", "b", "c"}},
+	})
+	x.Load(estates)
+	return x
+}
+
+// bruteForceEstates q に一致する物件をすべて並び順 o で並べる
+func bruteForceEstates(estates []Estate, q *estateQuery, o *searchOrder) []Estate {
+	hits := []Estate{}
+	for i := range estates {
+		if q.Match(&estates[i]) {
+			hits = append(hits, estates[i])
+		}
+	}
+	sort.Slice(hits, func(i, j int) bool {
+		return o.less(estateSortKey(o, &hits[i]), hits[i].ID, estateSortKey(o, &hits[j]), hits[j].ID)
+	})
+	return hits
+}
+
+func sameEstateIDs(a, b []Estate) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].ID != b[i].ID {
+			return false
+		}
+	}
+	return true
+}
+
+// TestEstateSearchPaging 条件を変えながらカーソルで辿った結果を総当たりで並べた結果と比べる
+func TestEstateSearchPaging(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	estates := randomEstates(rnd, 300)
+	x := newTestEstateIndex(estates)
+	for round := 0; round < 50; round++ {
+		q := newEstateQuery()
+		if rnd.Intn(2) == 0 {
+			q.RentRange = x.cond.Rent.Ranges[rnd.Intn(3)]
+		}
+		if rnd.Intn(2) == 0 {
+			q.DoorWidthRange = x.cond.DoorWidth.Ranges[rnd.Intn(2)]
+		}
+		if rnd.Intn(2) == 0 {
+			q.Features = []string{"a", "b"}[:rnd.Intn(2)+1]
+		}
+		if rnd.Intn(2) == 0 {
+			q.DoorHeight = bounds{Min: 2, Max: 4}
+		}
+		for _, o := range estateOrders {
+			want := bruteForceEstates(estates, q, o)
+			perPage := rnd.Intn(20) + 1
+
+			got := []Estate{}
+			var after *searchCursor
+			for {
+				count, page, next := x.Search(q, o, after, 0, perPage)
+				if count != int64(len(want)) {
+					t.Fatalf("%s: count %d, want %d", o.Name, count, len(want))
+				}
+				got = append(got, page...)
+				if next == nil {
+					break
+				}
+				after = next
+			}
+			if !sameEstateIDs(got, want) {
+				t.Fatalf("%s: got %v, want %v", o.Name, got, want)
+			}
+		}
+	}
+}
+
+// TestEstateIndexPut 1 件ずつの Put と Delete の後の並びと件数が作り直したインデックスと同じか
+func TestEstateIndexPut(t *testing.T) {
+	rnd := rand.New(rand.NewSource(2))
+	estates := randomEstates(rnd, 100)
+	x := newTestEstateIndex(estates)
+	rows := map[int64]Estate{}
+	for _, estate := range estates {
+		rows[estate.ID] = estate
+	}
+	for step := 0; step < 300; step++ {
+		estate := randomEstates(rnd, 1)[0]
+		estate.ID = int64(rnd.Intn(120) + 1)
+		if rnd.Intn(5) == 0 {
+			x.Delete(estate.ID)
+			delete(rows, estate.ID)
+			continue
+		}
+		if old, ok := rows[estate.ID]; ok {
+			estate.CreatedAt = old.CreatedAt
+		}
+		x.Put([]Estate{estate})
+		rows[estate.ID] = estate
+	}
+
+	all := make([]Estate, 0, len(rows))
+	for _, estate := range rows {
+		all = append(all, estate)
+	}
+	y := newTestEstateIndex(all)
+	for _, o := range estateOrders {
+		_, got, _ := x.Search(newEstateQuery(), o, nil, 0, len(all))
+		_, want, _ := y.Search(newEstateQuery(), o, nil, 0, len(all))
+		if !sameEstateIDs(got, want) {
+			t.Fatalf("%s: got %v, want %v", o.Name, got, want)
+		}
+	}
+	q := newEstateQuery()
+	q.Features = []string{"c"}
+	if got, want := x.Facets(q), y.Facets(q); !reflect.DeepEqual(got, want) {
+		t.Fatalf("facets got %v, want %v", got, want)
+	}
+}
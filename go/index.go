@@ -0,0 +1,312 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"math/bits"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// bitmap スロット番号の集合
+type bitmap []uint64
+
+func (b *bitmap) set(i int) {
+	w := i >> 6
+	if w >= len(*b) {
+		nb := make(bitmap, w+1, (w+1)*2)
+		copy(nb, *b)
+		*b = nb
+	}
+	(*b)[w] |= 1 << uint(i&63)
+}
+
+func (b bitmap) unset(i int) {
+	w := i >> 6
+	if w < len(b) {
+		b[w] &^= 1 << uint(i&63)
+	}
+}
+
+func (b bitmap) has(i int) bool {
+	w := i >> 6
+	return w < len(b) && b[w]&(1<<uint(i&63)) != 0
+}
+
+func (b bitmap) count() int64 {
+	n := 0
+	for _, w := range b {
+		n += bits.OnesCount64(w)
+	}
+	return int64(n)
+}
+
+func (b bitmap) clone() bitmap {
+	nb := make(bitmap, len(b))
+	copy(nb, b)
+	return nb
+}
+
+// andCount b と o の積集合の要素数
+func (b bitmap) andCount(o bitmap) int64 {
+	n := 0
+	for i := range b {
+		if i < len(o) {
+			n += bits.OnesCount64(b[i] & o[i])
+		}
+	}
+	return int64(n)
+}
+
+// and b を o との積集合にする
+func (b bitmap) and(o bitmap) {
+	for i := range b {
+		if i < len(o) {
+			b[i] &= o[i]
+		} else {
+			b[i] = 0
+		}
+	}
+}
+
+// or b に o を加えた和集合を返す
+func (b bitmap) or(o bitmap) bitmap {
+	if len(b) < len(o) {
+		nb := make(bitmap, len(o))
+		copy(nb, b)
+		b = nb
+	}
+	for i, w := range o {
+		b[i] |= w
+	}
+	return b
+}
+
+// keep f(slot) を満たさないスロットを外す
+func (b bitmap) keep(f func(slot int) bool) {
+	for i, w := range b {
+		for ; w != 0; w &= w - 1 {
+			slot := i<<6 + bits.TrailingZeros64(w)
+			if !f(slot) {
+				b.unset(slot)
+			}
+		}
+	}
+}
+
+// bounds 検索の min, max パラメータ. どちらも境界を含み, -1 は指定なし
+type bounds struct {
+	Min int64
+	Max int64
+}
+
+func noBounds() bounds {
+	return bounds{Min: -1, Max: -1}
+}
+
+func (b bounds) isSet() bool {
+	return b.Min >= 0 || b.Max >= 0
+}
+
+func (b bounds) contains(v int64) bool {
+	return (b.Min < 0 || v >= b.Min) && (b.Max < 0 || v <= b.Max)
+}
+
+// rangeBuckets RangeCondition の Range ごとのビットマップ
+type rangeBuckets []bitmap
+
+func newRangeBuckets(cond RangeCondition) rangeBuckets {
+	return make(rangeBuckets, len(cond.Ranges))
+}
+
+func inRange(r *Range, v int64) bool {
+	return (r.Min == -1 || v >= r.Min) && (r.Max == -1 || v < r.Max)
+}
+
+func (rb rangeBuckets) add(cond RangeCondition, slot int, v int64) {
+	for i, r := range cond.Ranges {
+		if i < len(rb) && inRange(r, v) {
+			rb[i].set(slot)
+		}
+	}
+}
+
+// counts hits のうち各 Range に入る要素数. RangeID 順
+func (rb rangeBuckets) counts(hits bitmap) []int64 {
+	counts := make([]int64, len(rb))
+	for i, b := range rb {
+		counts[i] = hits.andCount(b)
+	}
+	return counts
+}
+
+func (rb rangeBuckets) remove(slot int) {
+	for _, b := range rb {
+		b.unset(slot)
+	}
+}
+
+// filterRange hits を r に入るスロットに絞る. r が cond の Range ならバケットを使い,
+// 差し替え前の検索条件で解釈された Range なら value で 1 件ずつ見る
+func filterRange(hits bitmap, rb rangeBuckets, cond RangeCondition, r *Range, value func(slot int) int64) {
+	if r == nil {
+		return
+	}
+	if int(r.ID) < len(cond.Ranges) && cond.Ranges[r.ID] == r {
+		hits.and(rb[r.ID])
+		return
+	}
+	hits.keep(func(slot int) bool { return inRange(r, value(slot)) })
+}
+
+// tokenIndex 文字列の値ごとのビットマップ
+type tokenIndex map[string]bitmap
+
+func (t tokenIndex) add(token string, slot int) {
+	b := t[token]
+	b.set(slot)
+	t[token] = b
+}
+
+func (t tokenIndex) remove(token string, slot int) {
+	t[token].unset(slot)
+}
+
+// any tokens のいずれかを持つスロットの集合
+func (t tokenIndex) any(tokens []string) bitmap {
+	b := bitmap{}
+	for _, token := range tokens {
+		b = b.or(t[token])
+	}
+	return b
+}
+
+// counts hits のうち list の各値を持つ要素数
+func (t tokenIndex) counts(hits bitmap, list []string) map[string]int64 {
+	counts := make(map[string]int64, len(list))
+	for _, token := range list {
+		counts[token] = hits.andCount(t[token])
+	}
+	return counts
+}
+
+// splitFeatures カンマ区切りの features を重複のない特徴名の集合にする
+func splitFeatures(features string) []string {
+	tokens := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, f := range strings.Split(features, ",") {
+		f = strings.TrimSpace(f)
+		if f == "" || seen[f] {
+			continue
+		}
+		seen[f] = true
+		tokens = append(tokens, f)
+	}
+	return tokens
+}
+
+// normalizeFeatures splitFeatures と同じく区切った値をカンマだけで繋ぎ直す.
+// 保存する値をこの形にしておけば FIND_IN_SET でもインデックスと同じ判定になる
+func normalizeFeatures(features string) string {
+	return strings.Join(splitFeatures(features), ",")
+}
+
+// searchOrder 検索結果の並び順. Column の値の昇順 (Desc なら降順) に並べ, 同じ値なら id の昇順にする
+type searchOrder struct {
+	Name   string
+	Column string
+	Desc   bool
+}
+
+// less 値が ka, id が ida の行が kb, idb の行より前に来るか
+func (o *searchOrder) less(ka, ida, kb, idb int64) bool {
+	if ka != kb {
+		return (ka < kb) != o.Desc
+	}
+	return ida < idb
+}
+
+// findOrder orders から name の並び順を探す. name が空なら先頭の既定の並び順を返す
+func findOrder(orders []*searchOrder, name string) (*searchOrder, error) {
+	if name == "" {
+		return orders[0], nil
+	}
+	for _, o := range orders {
+		if o.Name == name {
+			return o, nil
+		}
+	}
+	return nil, fmt.Errorf("Unexpected sort: %s", name)
+}
+
+// removeSlot order から slot を外す
+func removeSlot(order []int, slot int) []int {
+	for i, s := range order {
+		if s == slot {
+			return append(order[:i], order[i+1:]...)
+		}
+	}
+	return order
+}
+
+// insertSlot order の i 番目に slot を入れる
+func insertSlot(order []int, i, slot int) []int {
+	order = append(order, 0)
+	copy(order[i+1:], order[i:])
+	order[i] = slot
+	return order
+}
+
+func orderNames(orders []*searchOrder) []string {
+	names := make([]string, len(orders))
+	for i, o := range orders {
+		names[i] = o.Name
+	}
+	return names
+}
+
+// searchCursor 検索結果の並び Order での位置. Key はその並び順の Column の値.
+// クライアントには Encode した文字列で渡す
+type searchCursor struct {
+	Order string
+	Key   int64
+	ID    int64
+}
+
+func (sc *searchCursor) Encode() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%s:%d:%d", sc.Order, sc.Key, sc.ID)))
+}
+
+func decodeSearchCursor(s string) (*searchCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	parts := strings.Split(string(b), ":")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	key, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	id, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	return &searchCursor{Order: parts[0], Key: key, ID: id}, nil
+}
+
+// rowLocks id ごとの排他. 行を更新するトランザクションの開始からインデックスへの反映までを囲み,
+// インデックスが DB のコミットと同じ順に更新されるようにする. 同じ添字に落ちた id どうしも待ち合う
+type rowLocks [256]sync.Mutex
+
+// Lock id の排他を取り, 外す関数を返す
+func (l *rowLocks) Lock(id int64) func() {
+	m := &l[uint64(id)%uint64(len(l))]
+	m.Lock()
+	return m.Unlock
+}
+
+var chairLocks, estateLocks rowLocks
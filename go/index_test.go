@@ -0,0 +1,44 @@
+package main
+
+import "testing"
+
+func TestBitmap(t *testing.T) {
+	var a, b bitmap
+	a.set(1)
+	a.set(70)
+	a.set(130)
+	b.set(70)
+	b.set(200)
+	if a.count() != 3 || !a.has(130) || a.has(2) {
+		t.Fatalf("set: %v", a)
+	}
+	if n := a.andCount(b); n != 1 {
+		t.Fatalf("andCount: %d", n)
+	}
+	if or := a.or(b); or.count() != 4 || !or.has(200) {
+		t.Fatalf("or: %v", or)
+	}
+	c := a.clone()
+	c.and(b)
+	if c.count() != 1 || !c.has(70) || a.count() != 3 {
+		t.Fatalf("and: %v, original %v", c, a)
+	}
+	a.unset(70)
+	a.keep(func(slot int) bool { return slot > 100 })
+	if a.count() != 1 || !a.has(130) {
+		t.Fatalf("unset and keep: %v", a)
+	}
+}
+
+func TestSearchCursorEncode(t *testing.T) {
+	cur := searchCursor{Order: "price_desc", Key: -3, ID: 42}
+	got, err := decodeSearchCursor(cur.Encode())
+	if err != nil || *got != cur {
+		t.Fatalf("got %v, %v", got, err)
+	}
+	for _, s := range []string{"", "!!", "cHJpY2U"} {
+		if _, err := decodeSearchCursor(s); err == nil {
+			t.Fatalf("decoded %q", s)
+		}
+	}
+}
@@ -2,18 +2,21 @@ package main
 
 import (
 	"bytes"
+	"crypto/subtle"
 	"database/sql"
 	"encoding/csv"
 	"encoding/json"
 	"fmt"
 	"io"
-	"io/ioutil"
 	goLog "log"
+	"math"
 	"net"
 	"net/http"
+	"net/mail"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"reflect"
 	"strconv"
 	"strings"
 	"sync"
@@ -32,8 +35,9 @@ const NazotteLimit = 50
 
 var db *sqlx.DB
 var mySQLConnectionData *MySQLConnectionEnv
-var chairSearchCondition ChairSearchCondition
-var estateSearchCondition EstateSearchCondition
+
+// searchMaxPerPage 検索 API の perPage の上限. SEARCH_MAX_PER_PAGE で変えられる
+var searchMaxPerPage = 100
 
 type InitializeResponse struct {
 	Language string `json:"language"`
@@ -53,11 +57,28 @@ type Chair struct {
 	Kind        string `db:"kind" json:"kind"`
 	Popularity  int64  `db:"popularity" json:"-"`
 	Stock       int64  `db:"stock" json:"-"`
+	// CreatedAt 最初に登録された日時. 更新や取り込みで置き換えても変わらない
+	CreatedAt time.Time `db:"created_at" json:"-"`
 }
 
 type ChairSearchResponse struct {
 	Count  int64   `json:"count"`
 	Chairs []Chair `json:"chairs"`
+	// NextCursor 続きがあるときだけ返す. cursor パラメータに渡すと次のページを返す
+	NextCursor string `json:"next_cursor,omitempty"`
+	// Facets facets=true のときだけ返す
+	Facets *ChairFacets `json:"facets,omitempty"`
+}
+
+// ChairFacets 検索結果を chair/search/condition の選択肢ごとに数えたもの. 範囲は RangeID 順に並べる
+type ChairFacets struct {
+	Price   []int64          `json:"price"`
+	Height  []int64          `json:"height"`
+	Width   []int64          `json:"width"`
+	Depth   []int64          `json:"depth"`
+	Color   map[string]int64 `json:"color"`
+	Kind    map[string]int64 `json:"kind"`
+	Feature map[string]int64 `json:"feature"`
 }
 
 type ChairListResponse struct {
@@ -78,18 +99,121 @@ type Estate struct {
 	DoorWidth   int64   `db:"door_width" json:"doorWidth"`
 	Features    string  `db:"features" json:"features"`
 	Popularity  int64   `db:"popularity" json:"-"`
+	// CreatedAt 最初に登録された日時. 更新や取り込みで置き換えても変わらない
+	CreatedAt time.Time `db:"created_at" json:"-"`
 }
 
 //EstateSearchResponse estate/searchへのレスポンスの形式
 type EstateSearchResponse struct {
 	Count   int64    `json:"count"`
 	Estates []Estate `json:"estates"`
+	// NextCursor 続きがあるときだけ返す. cursor パラメータに渡すと次のページを返す
+	NextCursor string `json:"next_cursor,omitempty"`
+	// Facets facets=true のときだけ返す
+	Facets *EstateFacets `json:"facets,omitempty"`
+}
+
+// EstateFacets 検索結果を estate/search/condition の選択肢ごとに数えたもの. 範囲は RangeID 順に並べる
+type EstateFacets struct {
+	DoorHeight []int64          `json:"doorHeight"`
+	DoorWidth  []int64          `json:"doorWidth"`
+	Rent       []int64          `json:"rent"`
+	Feature    map[string]int64 `json:"feature"`
 }
 
 type EstateListResponse struct {
 	Estates []Estate `json:"estates"`
 }
 
+// ChairBody PUT, PATCH /api/chair/:id のリクエストとレスポンス. Chair では返さない popularity と stock も扱う
+type ChairBody struct {
+	Chair
+	Popularity int64 `json:"popularity"`
+	Stock      int64 `json:"stock"`
+}
+
+func newChairBody(chair Chair) ChairBody {
+	return ChairBody{Chair: chair, Popularity: chair.Popularity, Stock: chair.Stock}
+}
+
+// toChair id はパスの値を使い, ボディの id は無視する
+func (b ChairBody) toChair(id int64) Chair {
+	chair := b.Chair
+	chair.ID = id
+	chair.Popularity = b.Popularity
+	chair.Stock = b.Stock
+	chair.Features = normalizeFeatures(chair.Features)
+	return chair
+}
+
+// StockRequest chair/:id/stock へのリクエストボディ. add と set のどちらか一方を指定する
+type StockRequest struct {
+	Add *int64 `json:"add"`
+	Set *int64 `json:"set"`
+}
+
+// EstateBody PUT, PATCH /api/estate/:id のリクエストとレスポンス. Estate では返さない popularity も扱う
+type EstateBody struct {
+	Estate
+	Popularity int64 `json:"popularity"`
+}
+
+func newEstateBody(estate Estate) EstateBody {
+	return EstateBody{Estate: estate, Popularity: estate.Popularity}
+}
+
+// toEstate id はパスの値を使い, ボディの id は無視する
+func (b EstateBody) toEstate(id int64) Estate {
+	estate := b.Estate
+	estate.ID = id
+	estate.Popularity = b.Popularity
+	estate.Features = normalizeFeatures(estate.Features)
+	return estate
+}
+
+// BuyChairRequest chair/buy へのリクエストボディ
+type BuyChairRequest struct {
+	Email string `json:"email"`
+}
+
+// RequestDocumentRequest estate/req_doc へのリクエストボディ
+type RequestDocumentRequest struct {
+	Email string `json:"email"`
+}
+
+// ErrorResponse エラー時のレスポンスボディ
+type ErrorResponse struct {
+	Message string `json:"message"`
+}
+
+// Purchase 椅子の購入記録
+type Purchase struct {
+	ID         int64     `db:"id" json:"id"`
+	ChairID    int64     `db:"chair_id" json:"chairId"`
+	Email      string    `db:"email" json:"email"`
+	UserAgent  string    `db:"user_agent" json:"userAgent"`
+	RemoteAddr string    `db:"remote_addr" json:"remoteAddr"`
+	CreatedAt  time.Time `db:"created_at" json:"createdAt"`
+}
+
+type PurchaseListResponse struct {
+	Purchases []Purchase `json:"purchases"`
+}
+
+// DocumentRequest 物件の資料請求記録
+type DocumentRequest struct {
+	ID         int64     `db:"id" json:"id"`
+	EstateID   int64     `db:"estate_id" json:"estateId"`
+	Email      string    `db:"email" json:"email"`
+	UserAgent  string    `db:"user_agent" json:"userAgent"`
+	RemoteAddr string    `db:"remote_addr" json:"remoteAddr"`
+	CreatedAt  time.Time `db:"created_at" json:"createdAt"`
+}
+
+type DocumentRequestListResponse struct {
+	Requests []DocumentRequest `json:"requests"`
+}
+
 type Coordinate struct {
 	Latitude  float64 `json:"latitude"`
 	Longitude float64 `json:"longitude"`
@@ -115,21 +239,30 @@ type ListCondition struct {
 	List []string `json:"list"`
 }
 
+// PaginationCondition 検索 API の page, perPage に指定できる値の範囲
+type PaginationCondition struct {
+	MaxPerPage int `json:"maxPerPage"`
+}
+
 type EstateSearchCondition struct {
-	DoorWidth  RangeCondition `json:"doorWidth"`
-	DoorHeight RangeCondition `json:"doorHeight"`
-	Rent       RangeCondition `json:"rent"`
-	Feature    ListCondition  `json:"feature"`
+	DoorWidth  RangeCondition      `json:"doorWidth"`
+	DoorHeight RangeCondition      `json:"doorHeight"`
+	Rent       RangeCondition      `json:"rent"`
+	Feature    ListCondition       `json:"feature"`
+	Pagination PaginationCondition `json:"pagination"`
+	Sort       ListCondition       `json:"sort"`
 }
 
 type ChairSearchCondition struct {
-	Width   RangeCondition `json:"width"`
-	Height  RangeCondition `json:"height"`
-	Depth   RangeCondition `json:"depth"`
-	Price   RangeCondition `json:"price"`
-	Color   ListCondition  `json:"color"`
-	Feature ListCondition  `json:"feature"`
-	Kind    ListCondition  `json:"kind"`
+	Width      RangeCondition      `json:"width"`
+	Height     RangeCondition      `json:"height"`
+	Depth      RangeCondition      `json:"depth"`
+	Price      RangeCondition      `json:"price"`
+	Color      ListCondition       `json:"color"`
+	Feature    ListCondition       `json:"feature"`
+	Kind       ListCondition       `json:"kind"`
+	Pagination PaginationCondition `json:"pagination"`
+	Sort       ListCondition       `json:"sort"`
 }
 
 type BoundingBox struct {
@@ -149,24 +282,49 @@ type MySQLConnectionEnv struct {
 
 type RecordMapper struct {
 	Record []string
+	// Columns Record の各列の列名. Decode での対応付けとエラーに使う
+	Columns []string
 
 	offset int
-	err    error
+	errs   []*RecordError
 }
 
-func (r *RecordMapper) next() (string, error) {
-	if r.err != nil {
-		return "", r.err
+// RecordError RecordMapper で読み取れなかった値
+type RecordError struct {
+	Column string
+	Value  string
+	Reason string
+}
+
+func (e *RecordError) Error() string {
+	return fmt.Sprintf("%s: %s (%q)", e.Column, e.Reason, e.Value)
+}
+
+func (r *RecordMapper) column(i int) string {
+	if i < len(r.Columns) {
+		return r.Columns[i]
 	}
+	return strconv.Itoa(i + 1)
+}
+
+func (r *RecordMapper) next() (string, error) {
 	if r.offset >= len(r.Record) {
-		r.err = fmt.Errorf("too many read")
-		return "", r.err
+		err := &RecordError{Column: r.column(r.offset), Reason: "too few columns"}
+		if r.offset == len(r.Record) {
+			r.errs = append(r.errs, err)
+		}
+		r.offset++
+		return "", err
 	}
 	s := r.Record[r.offset]
 	r.offset++
 	return s, nil
 }
 
+func (r *RecordMapper) fail(s, reason string) {
+	r.errs = append(r.errs, &RecordError{Column: r.column(r.offset - 1), Value: s, Reason: reason})
+}
+
 func (r *RecordMapper) NextInt() int {
 	s, err := r.next()
 	if err != nil {
@@ -176,7 +334,7 @@ func (r *RecordMapper) NextInt() int {
 	i, err := strconv.Atoi(s)
 	if err != nil {
 		goLog.Println(err)
-		r.err = err
+		r.fail(s, "not an integer")
 		return 0
 	}
 	return i
@@ -191,7 +349,7 @@ func (r *RecordMapper) NextFloat() float64 {
 	f, err := strconv.ParseFloat(s, 64)
 	if err != nil {
 		goLog.Println(err)
-		r.err = err
+		r.fail(s, "not a number")
 		return 0
 	}
 	return f
@@ -206,8 +364,58 @@ func (r *RecordMapper) NextString() string {
 	return s
 }
 
+// Decode Columns の列名と db タグが一致する dst のフィールドに値を読み込む. Columns より多い列はエラーにする
+func (r *RecordMapper) Decode(dst interface{}) {
+	if n := len(r.Columns); len(r.Record) > n {
+		r.errs = append(r.errs, &RecordError{Column: r.column(n), Value: r.Record[n], Reason: "too many columns"})
+	}
+	v := reflect.ValueOf(dst).Elem()
+	fields := recordFields(v.Type())
+	for i, column := range r.Columns {
+		f, ok := fields[column]
+		if !ok {
+			continue
+		}
+		r.offset = i
+		switch field := v.Field(f); field.Kind() {
+		case reflect.Int64:
+			field.SetInt(int64(r.NextInt()))
+		case reflect.Float64:
+			field.SetFloat(r.NextFloat())
+		case reflect.String:
+			field.SetString(r.NextString())
+		}
+	}
+}
+
+var recordFieldsCache sync.Map
+
+// recordFields db タグからフィールドの添字への対応
+func recordFields(t reflect.Type) map[string]int {
+	if fields, ok := recordFieldsCache.Load(t); ok {
+		return fields.(map[string]int)
+	}
+	fields := make(map[string]int, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		if tag := t.Field(i).Tag.Get("db"); tag != "" && tag != "-" {
+			fields[tag] = i
+		}
+	}
+	recordFieldsCache.Store(t, fields)
+	return fields
+}
+
+// Err 最初に読み取れなかった値のエラーを返す
 func (r *RecordMapper) Err() error {
-	return r.err
+	if len(r.errs) == 0 {
+		return nil
+	}
+	return r.errs[0]
+}
+
+// Errors 読み取れなかったすべての値のエラーを返す
+func (r *RecordMapper) Errors() []*RecordError {
+	return r.errs
 }
 
 func NewMySQLConnectionEnv() *MySQLConnectionEnv {
@@ -228,28 +436,16 @@ func getEnv(key, defaultValue string) string {
 	return defaultValue
 }
 
-//ConnectDB isuumoデータベースに接続する
+//ConnectDB isuumoデータベースに接続する. created_at は Go 側で UTC として書き読みするのでセッションのタイムゾーンも UTC に固定する
 func (mc *MySQLConnectionEnv) ConnectDB() (*sqlx.DB, error) {
-	dsn := fmt.Sprintf("%v:%v@tcp(%v:%v)/%v?interpolateParams=true", mc.User, mc.Password, mc.Host, mc.Port, mc.DBName)
+	dsn := fmt.Sprintf("%v:%v@tcp(%v:%v)/%v?interpolateParams=true&parseTime=true&time_zone=%%27%%2B00%%3A00%%27", mc.User, mc.Password, mc.Host, mc.Port, mc.DBName)
 	return sqlx.Open("mysql", dsn)
 }
 
 func init() {
-	jsonText, err := ioutil.ReadFile("../fixture/chair_condition.json")
-	if err != nil {
-		goLog.Println(err)
-		fmt.Printf("%v\n", err)
-		os.Exit(1)
+	if n, err := strconv.Atoi(getEnv("SEARCH_MAX_PER_PAGE", "")); err == nil && n > 0 {
+		searchMaxPerPage = n
 	}
-	json.Unmarshal(jsonText, &chairSearchCondition)
-
-	jsonText, err = ioutil.ReadFile("../fixture/estate_condition.json")
-	if err != nil {
-		goLog.Println(err)
-		fmt.Printf("%v\n", err)
-		os.Exit(1)
-	}
-	json.Unmarshal(jsonText, &estateSearchCondition)
 
 	http.DefaultTransport.(*http.Transport).MaxIdleConns = 0
 	http.DefaultTransport.(*http.Transport).MaxIdleConnsPerHost = 4096
@@ -279,44 +475,94 @@ func (j *JSONSerializer) Deserialize(c echo.Context, i interface{}) error {
 	return err
 }
 
-type omLowPriceChairT struct {
-	M sync.RWMutex
-	V []Chair
+// newRequestBodyError Deserialize のエラーをレスポンスボディにする
+func newRequestBodyError(err error) ErrorResponse {
+	if he, ok := err.(*echo.HTTPError); ok {
+		return ErrorResponse{Message: fmt.Sprint(he.Message)}
+	}
+	return ErrorResponse{Message: "invalid request body"}
+}
+
+// validateEmail RFC 5322 の addr-spec として解釈できるメールアドレスかを検証する
+func validateEmail(email string) error {
+	if email == "" {
+		return fmt.Errorf("email is required")
+	}
+	if len(email) > 254 {
+		return fmt.Errorf("email is too long")
+	}
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email {
+		return fmt.Errorf("email is invalid")
+	}
+	return nil
 }
 
-var omLowPriceChair omLowPriceChairT
+// omLowPriceChair 在庫のある椅子を price asc, id asc に並べた先頭 Limit 件
+var omLowPriceChair = newTopN(Limit, lessChairByPrice, chairID, toChairs)
 
-func (o *omLowPriceChairT) Get() []Chair {
-	o.M.RLock()
-	defer o.M.RUnlock()
-	return o.V
+func lessChairByPrice(a, b interface{}) bool {
+	x, y := a.(Chair), b.(Chair)
+	if x.Price != y.Price {
+		return x.Price < y.Price
+	}
+	return x.ID < y.ID
+}
+
+func chairID(v interface{}) int64 {
+	return v.(Chair).ID
 }
 
-func (o *omLowPriceChairT) Set(v []Chair) {
-	o.M.Lock()
-	o.V = v
-	o.M.Unlock()
+func toChairs(items []interface{}) interface{} {
+	chairs := make([]Chair, len(items))
+	for i, v := range items {
+		chairs[i] = v.(Chair)
+	}
+	return chairs
 }
 
-type omLowPriceEstateT struct {
-	M sync.RWMutex
-	V []Estate
+// omLowPriceEstate 物件を rent asc, id asc に並べた先頭 Limit 件
+var omLowPriceEstate = newTopN(Limit, lessEstateByRent, estateID, toEstates)
+
+func lessEstateByRent(a, b interface{}) bool {
+	x, y := a.(Estate), b.(Estate)
+	if x.Rent != y.Rent {
+		return x.Rent < y.Rent
+	}
+	return x.ID < y.ID
 }
 
-var omLowPriceEstate omLowPriceEstateT
+func estateID(v interface{}) int64 {
+	return v.(Estate).ID
+}
 
-func (o *omLowPriceEstateT) Get() []Estate {
-	o.M.RLock()
-	defer o.M.RUnlock()
-	return o.V
+func toEstates(items []interface{}) interface{} {
+	estates := make([]Estate, len(items))
+	for i, v := range items {
+		estates[i] = v.(Estate)
+	}
+	return estates
 }
 
-func (o *omLowPriceEstateT) Set(v []Estate) {
-	o.M.Lock()
-	o.V = v
-	o.M.Unlock()
+// extractRealIP X-Real-IP は nginx が付けたものだけを信用する. nginx からは unix ソケットで繋がるので
+// RemoteAddr にアドレスがない接続とループバックからの接続だけを nginx からとみなす
+func extractRealIP() echo.IPExtractor {
+	fromLoopback := echo.ExtractIPFromRealIPHeader(echo.TrustLinkLocal(false), echo.TrustPrivateNet(false))
+	return func(req *http.Request) string {
+		if _, _, err := net.SplitHostPort(req.RemoteAddr); err != nil {
+			return req.Header.Get(echo.HeaderXRealIP)
+		}
+		return fromLoopback(req)
+	}
 }
 
+// adminAuth 管理者向け API に ADMIN_TOKEN の Bearer 認証をかける.
+// ADMIN_TOKEN は必須で, 設定されていなければ管理者向け API はすべて 401 を返す
+var adminAuth = middleware.KeyAuth(func(key string, c echo.Context) (bool, error) {
+	token := getEnv("ADMIN_TOKEN", "")
+	return token != "" && subtle.ConstantTimeCompare([]byte(key), []byte(token)) == 1, nil
+})
+
 func main() {
 	// TODO
 	goLog.SetFlags(goLog.Lshortfile)
@@ -328,33 +574,62 @@ func main() {
 	defer logfile.Close()
 	goLog.SetOutput(io.MultiWriter(logfile, os.Stdout))
 
+	// 検索条件はファイルを先に読み, 壊れていれば起動しない. テストで fixture がなくても動くよう init では読まない
+	chair, estate, err := readSearchConditions()
+	if err != nil {
+		goLog.Println(err)
+		fmt.Printf("%v\n", err)
+		os.Exit(1)
+	}
+	setSearchConditions(chair, estate)
+	watchSearchConditionReload()
+
 	// Echo instance
 	e := echo.New()
 	e.JSONSerializer = &JSONSerializer{}
+	e.IPExtractor = extractRealIP()
 
 	// Middleware
 	e.Use(middleware.Recover())
 
 	// Initialize
 	e.POST("/initialize", initialize)
+	e.POST("/api/admin/search_condition/reload", postReloadSearchCondition, adminAuth)
+	e.GET("/api/admin/chair/search/condition", getAdminChairSearchCondition, adminAuth)
+	e.PUT("/api/admin/chair/search/condition", putChairSearchCondition, adminAuth)
+	e.DELETE("/api/admin/chair/search/condition", deleteChairSearchCondition, adminAuth)
+	e.GET("/api/admin/estate/search/condition", getAdminEstateSearchCondition, adminAuth)
+	e.PUT("/api/admin/estate/search/condition", putEstateSearchCondition, adminAuth)
+	e.DELETE("/api/admin/estate/search/condition", deleteEstateSearchCondition, adminAuth)
 
 	// Chair Handler
 	// * path
 	e.GET("/api/chair/:id", getChairDetail)
 	e.POST("/api/chair", postChair)
 	e.GET("/api/chair/search", searchChairs)
+	e.GET("/api/chair/export", exportChairs, adminAuth)
 	e.GET("/api/chair/low_priced", getLowPricedChair)
 	e.GET("/api/chair/search/condition", getChairSearchCondition)
 	e.POST("/api/chair/buy/:id", buyChair)
+	e.GET("/api/chair/:id/purchases", getChairPurchases, adminAuth)
+	e.PUT("/api/chair/:id", putChair, adminAuth)
+	e.PATCH("/api/chair/:id", patchChair, adminAuth)
+	e.DELETE("/api/chair/:id", deleteChair, adminAuth)
+	e.POST("/api/chair/:id/stock", postChairStock, adminAuth)
 
 	// Estate Handler
 	e.GET("/api/estate/:id", getEstateDetail)
 	e.POST("/api/estate", postEstate)
 	e.GET("/api/estate/search", searchEstates)
+	e.GET("/api/estate/export", exportEstates, adminAuth)
 	e.GET("/api/estate/low_priced", getLowPricedEstate)
 	e.POST("/api/estate/req_doc/:id", postEstateRequestDocument)
 	e.POST("/api/estate/nazotte", searchEstateNazotte)
 	e.GET("/api/estate/search/condition", getEstateSearchCondition)
+	e.GET("/api/estate/:id/requests", getEstateDocumentRequests, adminAuth)
+	e.PUT("/api/estate/:id", putEstate, adminAuth)
+	e.PATCH("/api/estate/:id", patchEstate, adminAuth)
+	e.DELETE("/api/estate/:id", deleteEstate, adminAuth)
 	e.GET("/api/recommended_estate/:id", searchRecommendedEstateWithChair)
 
 	// Unix Domain Socket
@@ -372,6 +647,10 @@ func main() {
 	}
 	e.Listener = l
 
+	if getEnv("ADMIN_TOKEN", "") == "" {
+		goLog.Println("ADMIN_TOKEN is not set; admin APIs will reject every request")
+	}
+
 	mySQLConnectionData = NewMySQLConnectionEnv()
 
 	db, err = mySQLConnectionData.ConnectDB()
@@ -394,6 +673,16 @@ func main() {
 		}
 		time.Sleep(time.Second * 1)
 	}
+	// 管理画面で変更された検索条件を反映する
+	if err := reloadSearchConditions(); err != nil {
+		goLog.Println(err)
+	}
+	if err := loadChairIndex(); err != nil {
+		goLog.Println(err)
+	}
+	if err := loadEstateIndex(); err != nil {
+		goLog.Println(err)
+	}
 
 	// Start server
 	serverPort := fmt.Sprintf(":%v", getEnv("SERVER_PORT", "1323"))
@@ -427,19 +716,60 @@ func initialize(c echo.Context) error {
 		}
 	}
 
-	var chairs []Chair
-	db.Select(&chairs, "SELECT * FROM chair WHERE stock > 0 ORDER BY price ASC, id ASC LIMIT ?", Limit)
-	omLowPriceChair.Set(chairs)
-
-	var estates []Estate
-	db.Select(&estates, "SELECT * FROM estate ORDER BY rent ASC, id ASC LIMIT ?", Limit)
-	omLowPriceEstate.Set(estates)
+	// スキーマを作り直したので管理画面で変更された検索条件も消えている
+	if err := reloadSearchConditions(); err != nil {
+		goLog.Println(err)
+		c.Logger().Errorf("failed to reload search conditions : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if err := loadChairIndex(); err != nil {
+		goLog.Println(err)
+		c.Logger().Errorf("failed to load chair index : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if err := loadEstateIndex(); err != nil {
+		goLog.Println(err)
+		c.Logger().Errorf("failed to load estate index : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
 
 	return c.JSON(http.StatusOK, InitializeResponse{
 		Language: "go",
 	})
 }
 
+func loadChairIndex() error {
+	var chairs []Chair
+	if err := db.Select(&chairs, "SELECT * FROM chair"); err != nil {
+		return err
+	}
+	chairIdx.Load(chairs)
+
+	inStock := make([]interface{}, 0, len(chairs))
+	for _, chair := range chairs {
+		if chair.Stock > 0 {
+			inStock = append(inStock, chair)
+		}
+	}
+	omLowPriceChair.Reset(inStock)
+	return nil
+}
+
+func loadEstateIndex() error {
+	var estates []Estate
+	if err := db.Select(&estates, "SELECT * FROM estate"); err != nil {
+		return err
+	}
+	estateIdx.Load(estates)
+
+	items := make([]interface{}, 0, len(estates))
+	for _, estate := range estates {
+		items = append(items, estate)
+	}
+	omLowPriceEstate.Reset(items)
+	return nil
+}
+
 func getChairDetail(c echo.Context) error {
 	id, err := strconv.Atoi(c.Param("id"))
 	if err != nil {
@@ -481,263 +811,667 @@ func postChair(c echo.Context) error {
 		return c.NoContent(http.StatusInternalServerError)
 	}
 	defer f.Close()
-	records, err := csv.NewReader(f).ReadAll()
-	if err != nil {
-		goLog.Println(err)
-		c.Logger().Errorf("failed to read csv: %v", err)
-		return c.NoContent(http.StatusInternalServerError)
-	}
 
-	args := make([]interface{}, 0, len(records)*13)
-	placeHolders := &strings.Builder{}
-	for i, row := range records {
-		rm := RecordMapper{Record: row}
-		id := rm.NextInt()
-		name := rm.NextString()
-		description := rm.NextString()
-		thumbnail := rm.NextString()
-		price := rm.NextInt()
-		height := rm.NextInt()
-		width := rm.NextInt()
-		depth := rm.NextInt()
-		color := rm.NextString()
-		features := rm.NextString()
-		kind := rm.NextString()
-		popularity := rm.NextInt()
-		stock := rm.NextInt()
-		if err := rm.Err(); err != nil {
-			c.Logger().Errorf("failed to read record: %v", err)
-			return c.NoContent(http.StatusBadRequest)
-		}
-		args = append(args, id, name, description, thumbnail, price, height, width, depth, color, features, kind, popularity, stock)
-		if i == 0 {
-			placeHolders.WriteString(" (?,?,?,?,?,?,?,?,?,?,?,?,null,?)")
-		} else {
-			placeHolders.WriteString(",(?,?,?,?,?,?,?,?,?,?,?,?,null,?)")
-		}
+	dryRun := c.FormValue("dryRun") == "true"
+	hasHeader := c.FormValue("header") == "true"
+	onInvalid := c.FormValue("onInvalid")
+	if onInvalid != "" && onInvalid != "reject" && onInvalid != "skip" {
+		c.Logger().Infof("onInvalid invalid : %v", onInvalid)
+		return c.NoContent(http.StatusBadRequest)
+	}
+	mode := c.FormValue("mode")
+	if mode == "" {
+		mode = importInsert
+	}
+	if mode != importInsert && mode != importUpsert && mode != importReplace {
+		c.Logger().Infof("mode invalid : %v", mode)
+		return c.NoContent(http.StatusBadRequest)
 	}
-	_, err = db.Exec("INSERT INTO chair(id, name, description, thumbnail, price, height, width, depth, color, features, kind, popularity, popularity_desc, stock) VALUES"+placeHolders.String(), args...)
+
+	tx, err := db.Beginx()
 	if err != nil {
 		goLog.Println(err)
-		c.Logger().Errorf("failed to insert chair: %v", err)
+		c.Logger().Errorf("failed to begin tx: %v", err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
-
-	var chairs []Chair
-	db.Select(&chairs, "SELECT * FROM chair WHERE stock > 0 ORDER BY price ASC, id ASC LIMIT ?", Limit)
-	omLowPriceChair.Set(chairs)
-
-	return c.NoContent(http.StatusCreated)
-}
-
-func searchChairs(c echo.Context) error {
-	conditions := make([]string, 0)
-	params := make([]interface{}, 0)
-
-	if c.QueryParam("priceRangeId") != "" {
-		chairPrice, err := getRange(chairSearchCondition.Price, c.QueryParam("priceRangeId"))
+	defer tx.Rollback()
+
+	query, suffix := importStatement(mode, "chair",
+		[]string{"id", "name", "description", "thumbnail", "price", "height", "width", "depth", "color", "features", "kind", "popularity", "popularity_desc", "stock", "created_at"},
+		[]string{"name", "description", "thumbnail", "price", "height", "width", "depth", "color", "features", "kind", "popularity", "stock"})
+	inserter := newBulkInserter(tx, query, "(?,?,?,?,?,?,?,?,?,?,?,?,null,?,?)", suffix, csvChunkSize)
+	// 既存の行は created_at を更新しないので, 新しく入る行だけがこの日時になる
+	now := time.Now().UTC().Truncate(time.Microsecond)
+	chairs := make([]Chair, 0)
+	report := newCSVImportReport()
+	seen := make(map[int64]bool)
+	columns := chairCSVColumns
+	r := csv.NewReader(f)
+	r.ReuseRecord = true
+	r.FieldsPerRecord = -1
+	for row := 1; ; row++ {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
 		if err != nil {
+			// クォートの崩れなどがあると以降の行は読めないのでファイルごと拒否する
 			goLog.Println(err)
-			c.Echo().Logger.Infof("priceRangeID invalid, %v : %v", c.QueryParam("priceRangeId"), err)
-			return c.NoContent(http.StatusBadRequest)
+			c.Logger().Infof("failed to read csv: %v", err)
+			report.Add(row, []*RecordError{{Reason: err.Error()}})
+			return c.JSON(http.StatusBadRequest, report)
 		}
-
-		if chairPrice.Min != -1 {
-			conditions = append(conditions, "price >= ?")
-			params = append(params, chairPrice.Min)
+		if hasHeader && row == 1 {
+			columns = normalizeCSVHeader(record)
+			if errs := checkCSVHeader(columns, chairCSVColumns); len(errs) > 0 {
+				c.Logger().Infof("invalid csv header : %v", errs[0])
+				report.Add(row, errs)
+				return c.JSON(http.StatusBadRequest, report)
+			}
+			continue
 		}
-		if chairPrice.Max != -1 {
-			conditions = append(conditions, "price < ?")
-			params = append(params, chairPrice.Max)
+		rm := RecordMapper{Record: record, Columns: columns}
+		var chair Chair
+		rm.Decode(&chair)
+		chair.Features = normalizeFeatures(chair.Features)
+		errs := rm.Errors()
+		if len(errs) == 0 {
+			errs = validateChair(chair, seen, mode)
 		}
-	}
-
-	if c.QueryParam("heightRangeId") != "" {
-		chairHeight, err := getRange(chairSearchCondition.Height, c.QueryParam("heightRangeId"))
-		if err != nil {
-			goLog.Println(err)
-			c.Echo().Logger.Infof("heightRangeIf invalid, %v : %v", c.QueryParam("heightRangeId"), err)
-			return c.NoContent(http.StatusBadRequest)
+		if len(errs) > 0 {
+			report.Add(row, errs)
+			continue
 		}
-
-		if chairHeight.Min != -1 {
-			conditions = append(conditions, "height >= ?")
-			params = append(params, chairHeight.Min)
+		seen[chair.ID] = true
+		report.Valid++
+		if dryRun || (report.Invalid > 0 && onInvalid != "skip") {
+			continue
 		}
-		if chairHeight.Max != -1 {
-			conditions = append(conditions, "height < ?")
-			params = append(params, chairHeight.Max)
+		if err := inserter.Add(chair.ID, chair.Name, chair.Description, chair.Thumbnail, chair.Price, chair.Height, chair.Width, chair.Depth, chair.Color, chair.Features, chair.Kind, chair.Popularity, chair.Stock, now); err != nil {
+			goLog.Println(err)
+			c.Logger().Errorf("failed to insert chair: %v", err)
+			return c.NoContent(http.StatusInternalServerError)
 		}
+		chair.CreatedAt = now
+		chairs = append(chairs, chair)
 	}
-
-	if c.QueryParam("widthRangeId") != "" {
-		chairWidth, err := getRange(chairSearchCondition.Width, c.QueryParam("widthRangeId"))
-		if err != nil {
-			goLog.Println(err)
-			c.Echo().Logger.Infof("widthRangeID invalid, %v : %v", c.QueryParam("widthRangeId"), err)
-			return c.NoContent(http.StatusBadRequest)
+	if report.Invalid > 0 {
+		c.Logger().Infof("invalid chair records : %v", report.Invalid)
+		if onInvalid != "skip" {
+			return c.JSON(http.StatusBadRequest, report)
 		}
-
-		if chairWidth.Min != -1 {
-			conditions = append(conditions, "width >= ?")
-			params = append(params, chairWidth.Min)
+	}
+	if dryRun {
+		return c.JSON(http.StatusOK, report)
+	}
+	if err := inserter.Flush(); err != nil {
+		goLog.Println(err)
+		c.Logger().Errorf("failed to insert chair: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if mode == importReplace {
+		ids := make([]int64, len(chairs))
+		for i := range chairs {
+			ids[i] = chairs[i].ID
 		}
-		if chairWidth.Max != -1 {
-			conditions = append(conditions, "width < ?")
-			params = append(params, chairWidth.Max)
+		if report.Deleted, err = deleteMissing(tx, "chair", ids); err != nil {
+			goLog.Println(err)
+			c.Logger().Errorf("failed to delete chairs: %v", err)
+			return c.NoContent(http.StatusInternalServerError)
 		}
 	}
+	if err := tx.Commit(); err != nil {
+		goLog.Println(err)
+		c.Logger().Errorf("failed to commit tx: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
 
-	if c.QueryParam("depthRangeId") != "" {
-		chairDepth, err := getRange(chairSearchCondition.Depth, c.QueryParam("depthRangeId"))
-		if err != nil {
+	if mode == importReplace {
+		// 消した行もあるのでインデックスとキャッシュを DB から作り直す
+		if err := loadChairIndex(); err != nil {
 			goLog.Println(err)
-			c.Echo().Logger.Infof("depthRangeId invalid, %v : %v", c.QueryParam("depthRangeId"), err)
-			return c.NoContent(http.StatusBadRequest)
+			c.Logger().Errorf("failed to load chair index : %v", err)
+			return c.NoContent(http.StatusInternalServerError)
 		}
+		report.Imported = len(chairs)
+		return c.JSON(http.StatusCreated, report)
+	}
 
-		if chairDepth.Min != -1 {
-			conditions = append(conditions, "depth >= ?")
-			params = append(params, chairDepth.Min)
-		}
-		if chairDepth.Max != -1 {
-			conditions = append(conditions, "depth < ?")
-			params = append(params, chairDepth.Max)
+	chairIdx.Put(chairs)
+	for _, chair := range chairs {
+		if chair.Stock > 0 {
+			omLowPriceChair.Upsert(chair)
+		} else {
+			omLowPriceChair.Delete(chair.ID)
 		}
 	}
 
-	if c.QueryParam("kind") != "" {
-		conditions = append(conditions, "kind = ?")
-		params = append(params, c.QueryParam("kind"))
-	}
+	report.Imported = len(chairs)
+	return c.JSON(http.StatusCreated, report)
+}
 
-	if c.QueryParam("color") != "" {
-		conditions = append(conditions, "color = ?")
-		params = append(params, c.QueryParam("color"))
-	}
+func putChair(c echo.Context) error {
+	return updateChair(c, false)
+}
 
-	if c.QueryParam("features") != "" {
-		for _, f := range strings.Split(c.QueryParam("features"), ",") {
-			conditions = append(conditions, "features LIKE CONCAT('%', ?, '%')")
-			params = append(params, f)
-		}
+func patchChair(c echo.Context) error {
+	return updateChair(c, true)
+}
+
+// updateChair ボディの内容で椅子を置き換える. partial なら既存の値にボディにある項目だけを上書きする
+func updateChair(c echo.Context, partial bool) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		goLog.Println(err)
+		c.Echo().Logger.Infof("Request parameter \"id\" parse error : %v", err)
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Message: "invalid chair id"})
 	}
 
-	if len(conditions) == 0 {
-		c.Echo().Logger.Infof("Search condition not found")
-		return c.NoContent(http.StatusBadRequest)
+	// 行をロックしてから遅いクライアントを待たないよう, ボディは先に読み切っておく
+	raw, err := io.ReadAll(c.Request().Body)
+	if err != nil {
+		goLog.Println(err)
+		c.Echo().Logger.Infof("update chair failed : %v", err)
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Message: "invalid request body"})
 	}
 
-	conditions = append(conditions, "stock > 0")
+	// 他の更新や購入と入れ違いにインデックスを古い値で上書きしないよう, コミットとインデックスの更新を id ごとに並べる
+	defer chairLocks.Lock(int64(id))()
 
-	page, err := strconv.Atoi(c.QueryParam("page"))
+	tx, err := db.Beginx()
 	if err != nil {
 		goLog.Println(err)
-		c.Logger().Infof("Invalid format page parameter : %v", err)
-		return c.NoContent(http.StatusBadRequest)
+		c.Echo().Logger.Errorf("failed to create transaction : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
 	}
+	defer tx.Rollback()
 
-	perPage, err := strconv.Atoi(c.QueryParam("perPage"))
+	var current Chair
+	err = tx.Get(&current, "SELECT * FROM chair WHERE id = ? FOR UPDATE", id)
+	if err == sql.ErrNoRows {
+		c.Echo().Logger.Infof("updateChair chair id \"%v\" not found", id)
+		return c.JSON(http.StatusNotFound, ErrorResponse{Message: "chair not found"})
+	}
 	if err != nil {
 		goLog.Println(err)
-		c.Logger().Infof("Invalid format perPage parameter : %v", err)
-		return c.NoContent(http.StatusBadRequest)
+		c.Echo().Logger.Errorf("DB Execution Error: on getting a chair by id : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
 	}
 
-	searchQuery := "SELECT * FROM chair WHERE "
-	countQuery := "SELECT COUNT(*) FROM chair WHERE "
-	searchCondition := strings.Join(conditions, " AND ")
-	limitOffset := " ORDER BY popularity_desc, id ASC LIMIT ? OFFSET ?"
+	var body ChairBody
+	if partial {
+		body = newChairBody(current)
+	}
+	c.Request().Body = io.NopCloser(bytes.NewReader(raw))
+	if err := c.Echo().JSONSerializer.Deserialize(c, &body); err != nil {
+		c.Echo().Logger.Infof("update chair failed : %v", err)
+		return c.JSON(http.StatusBadRequest, newRequestBodyError(err))
+	}
+	chair := body.toChair(current.ID)
+	if errs := validateChair(chair, map[int64]bool{}, importUpsert); len(errs) > 0 {
+		c.Echo().Logger.Infof("update chair failed : %v", errs[0])
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Message: errs[0].Error()})
+	}
 
-	var res ChairSearchResponse
-	err = db.Get(&res.Count, countQuery+searchCondition, params...)
+	_, err = tx.Exec("UPDATE chair SET name = ?, description = ?, thumbnail = ?, price = ?, height = ?, width = ?, depth = ?, color = ?, features = ?, kind = ?, popularity = ?, stock = ? WHERE id = ?",
+		chair.Name, chair.Description, chair.Thumbnail, chair.Price, chair.Height, chair.Width, chair.Depth, chair.Color, chair.Features, chair.Kind, chair.Popularity, chair.Stock, chair.ID)
 	if err != nil {
 		goLog.Println(err)
-		c.Logger().Errorf("searchChairs DB execution error : %v", err)
+		c.Echo().Logger.Errorf("chair update failed : %v", err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
-
-	chairs := []Chair{}
-	params = append(params, perPage, page*perPage)
-	err = db.Select(&chairs, searchQuery+searchCondition+limitOffset, params...)
-	if err != nil {
+	if err := tx.Commit(); err != nil {
 		goLog.Println(err)
-		if err == sql.ErrNoRows {
-			return c.JSON(http.StatusOK, ChairSearchResponse{Count: 0, Chairs: []Chair{}})
-		}
-		c.Logger().Errorf("searchChairs DB execution error : %v", err)
+		c.Echo().Logger.Errorf("transaction commit error : %v", err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
-	res.Chairs = chairs
+	chairIdx.Put([]Chair{chair})
+	if chair.Stock > 0 {
+		omLowPriceChair.Upsert(chair)
+	} else {
+		omLowPriceChair.Delete(chair.ID)
+	}
 
-	return c.JSON(http.StatusOK, res)
+	return c.JSON(http.StatusOK, newChairBody(chair))
 }
 
-// * score
-func buyChair(c echo.Context) error {
-	m := echo.Map{}
-	if err := c.Bind(&m); err != nil {
-		c.Echo().Logger.Infof("post buy chair failed : %v", err)
+func deleteChair(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		goLog.Println(err)
+		c.Echo().Logger.Infof("Request parameter \"id\" parse error : %v", err)
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Message: "invalid chair id"})
+	}
+
+	defer chairLocks.Lock(int64(id))()
+	result, err := db.Exec("DELETE FROM chair WHERE id = ?", id)
+	if err != nil {
+		goLog.Println(err)
+		c.Echo().Logger.Errorf("chair delete failed : %v", err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		goLog.Println(err)
+		c.Echo().Logger.Errorf("chair delete failed : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if affected == 0 {
+		c.Echo().Logger.Infof("deleteChair chair id \"%v\" not found", id)
+		return c.JSON(http.StatusNotFound, ErrorResponse{Message: "chair not found"})
+	}
 
-	_, ok := m["email"].(string)
-	if !ok {
-		c.Echo().Logger.Info("post buy chair failed : email not found in request body")
-		return c.NoContent(http.StatusBadRequest)
+	chairIdx.Delete(int64(id))
+	omLowPriceChair.Delete(int64(id))
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// postChairStock 在庫を add だけ増やすか set にする. 在庫が戻った椅子は検索と low_priced に再び載る
+func postChairStock(c echo.Context) error {
+	var req StockRequest
+	if err := c.Echo().JSONSerializer.Deserialize(c, &req); err != nil {
+		c.Echo().Logger.Infof("post chair stock failed : %v", err)
+		return c.JSON(http.StatusBadRequest, newRequestBodyError(err))
+	}
+	if (req.Add == nil) == (req.Set == nil) {
+		c.Echo().Logger.Infof("post chair stock failed : exactly one of add and set is required")
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Message: "exactly one of add and set is required"})
 	}
 
 	id, err := strconv.Atoi(c.Param("id"))
 	if err != nil {
 		goLog.Println(err)
-		c.Echo().Logger.Infof("post buy chair failed : %v", err)
-		return c.NoContent(http.StatusBadRequest)
+		c.Echo().Logger.Infof("post chair stock failed : %v", err)
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Message: "invalid chair id"})
 	}
 
-	// tx, err := db.Beginx()
-	// if err != nil {
-	// 	goLog.Println(err)
-	// 	c.Echo().Logger.Errorf("failed to create transaction : %v", err)
-	// 	return c.NoContent(http.StatusInternalServerError)
-	// }
-	// defer tx.Rollback()
-
-	// var chair Chair
-	// err = tx.QueryRowx("SELECT * FROM chair WHERE id = ? AND stock > 0 FOR UPDATE", id).StructScan(&chair)
-	// if err != nil {
-	// 	goLog.Println(err)
-	// 	if err == sql.ErrNoRows {
-	// 		c.Echo().Logger.Infof("buyChair chair id \"%v\" not found", id)
-	// 		return c.NoContent(http.StatusNotFound)
-	// 	}
-	// 	c.Echo().Logger.Errorf("DB Execution Error: on getting a chair by id : %v", err)
-	// 	return c.NoContent(http.StatusInternalServerError)
-	// }
+	// 購入と入れ違いにインデックスの在庫を古い値で上書きしないよう, コミットとインデックスの更新を id ごとに並べる
+	defer chairLocks.Lock(int64(id))()
 
-	_, err = db.Exec("UPDATE chair SET stock = stock - 1 WHERE id = ? AND stock > 0", id)
+	tx, err := db.Beginx()
 	if err != nil {
-		if err == sql.ErrNoRows {
-			c.Echo().Logger.Infof("buyChair chair id \"%v\" not found", id)
-			return c.NoContent(http.StatusNotFound)
+		goLog.Println(err)
+		c.Echo().Logger.Errorf("failed to create transaction : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	defer tx.Rollback()
+
+	var chair Chair
+	err = tx.Get(&chair, "SELECT * FROM chair WHERE id = ? FOR UPDATE", id)
+	if err == sql.ErrNoRows {
+		c.Echo().Logger.Infof("postChairStock chair id \"%v\" not found", id)
+		return c.JSON(http.StatusNotFound, ErrorResponse{Message: "chair not found"})
+	}
+	if err != nil {
+		goLog.Println(err)
+		c.Echo().Logger.Errorf("DB Execution Error: on getting a chair by id : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	if req.Add != nil {
+		chair.Stock += *req.Add
+	} else {
+		chair.Stock = *req.Set
+	}
+	if chair.Stock < 0 || maxTinyIntUnsigned < chair.Stock {
+		c.Echo().Logger.Infof("post chair stock failed : stock out of range : %v", chair.Stock)
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Message: "stock out of range"})
+	}
+
+	_, err = tx.Exec("UPDATE chair SET stock = ? WHERE id = ?", chair.Stock, chair.ID)
+	if err != nil {
+		goLog.Println(err)
+		c.Echo().Logger.Errorf("chair stock update failed : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if err := tx.Commit(); err != nil {
+		goLog.Println(err)
+		c.Echo().Logger.Errorf("transaction commit error : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	chairIdx.Put([]Chair{chair})
+	if chair.Stock > 0 {
+		omLowPriceChair.Upsert(chair)
+	} else {
+		omLowPriceChair.Delete(chair.ID)
+	}
+
+	return c.JSON(http.StatusOK, newChairBody(chair))
+}
+
+// parsePagination page と perPage を検証する. cursor を使うときは page を省略できる
+func parsePagination(c echo.Context, hasCursor bool) (int, int, error) {
+	page := 0
+	if !hasCursor || c.QueryParam("page") != "" {
+		p, err := strconv.Atoi(c.QueryParam("page"))
+		if err != nil {
+			return 0, 0, fmt.Errorf("Invalid format page parameter : %v", err)
+		}
+		page = p
+	}
+
+	perPage, err := strconv.Atoi(c.QueryParam("perPage"))
+	if err != nil {
+		return 0, 0, fmt.Errorf("Invalid format perPage parameter : %v", err)
+	}
+
+	if perPage < 1 || searchMaxPerPage < perPage {
+		return 0, 0, fmt.Errorf("perPage out of range : %v", perPage)
+	}
+	if page < 0 || math.MaxInt32/perPage < page {
+		return 0, 0, fmt.Errorf("page out of range : %v", page)
+	}
+	return page, perPage, nil
+}
+
+// parseBounds nameMin, nameMax パラメータを 0 以上 max 以下の値として読む
+func parseBounds(c echo.Context, name string, max int64) (bounds, error) {
+	b := noBounds()
+	for _, p := range []struct {
+		param string
+		dst   *int64
+	}{
+		{name + "Min", &b.Min},
+		{name + "Max", &b.Max},
+	} {
+		s := c.QueryParam(p.param)
+		if s == "" {
+			continue
+		}
+		v, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return b, fmt.Errorf("%s invalid, %v : %v", p.param, s, err)
+		}
+		if v < 0 || max < v {
+			return b, fmt.Errorf("%s out of range, %v", p.param, s)
+		}
+		*p.dst = v
+	}
+	if b.Min >= 0 && b.Max >= 0 && b.Min > b.Max {
+		return b, fmt.Errorf("%sMin is greater than %sMax, %v > %v", name, name, b.Min, b.Max)
+	}
+	return b, nil
+}
+
+// parseChairQuery searchChairs と同じクエリパラメータから検索条件を作る
+func parseChairQuery(c echo.Context) (*chairQuery, error) {
+	q := newChairQuery()
+	// 途中で差し替えられても 1 つの検索条件で解釈する
+	cond := currentChairSearchCondition()
+
+	if c.QueryParam("priceRangeId") != "" {
+		r, err := getRange(cond.Price, c.QueryParam("priceRangeId"))
+		if err != nil {
+			return nil, fmt.Errorf("priceRangeID invalid, %v : %v", c.QueryParam("priceRangeId"), err)
+		}
+		q.PriceRange = r
+	}
+
+	if c.QueryParam("heightRangeId") != "" {
+		r, err := getRange(cond.Height, c.QueryParam("heightRangeId"))
+		if err != nil {
+			return nil, fmt.Errorf("heightRangeIf invalid, %v : %v", c.QueryParam("heightRangeId"), err)
+		}
+		q.HeightRange = r
+	}
+
+	if c.QueryParam("widthRangeId") != "" {
+		r, err := getRange(cond.Width, c.QueryParam("widthRangeId"))
+		if err != nil {
+			return nil, fmt.Errorf("widthRangeID invalid, %v : %v", c.QueryParam("widthRangeId"), err)
+		}
+		q.WidthRange = r
+	}
+
+	if c.QueryParam("depthRangeId") != "" {
+		r, err := getRange(cond.Depth, c.QueryParam("depthRangeId"))
+		if err != nil {
+			return nil, fmt.Errorf("depthRangeId invalid, %v : %v", c.QueryParam("depthRangeId"), err)
+		}
+		q.DepthRange = r
+	}
+
+	for _, b := range []struct {
+		name string
+		dst  *bounds
+		max  int64
+	}{
+		{"price", &q.Price, maxSmallIntUnsigned},
+		{"height", &q.Height, maxTinyIntUnsigned},
+		{"width", &q.Width, maxTinyIntUnsigned},
+		{"depth", &q.Depth, maxTinyIntUnsigned},
+	} {
+		v, err := parseBounds(c, b.name, b.max)
+		if err != nil {
+			return nil, err
+		}
+		*b.dst = v
+	}
+
+	if c.QueryParam("kind") != "" {
+		kinds, err := getListItems(cond.Kind, c.QueryParam("kind"))
+		if err != nil {
+			return nil, fmt.Errorf("kind invalid, %v : %v", c.QueryParam("kind"), err)
+		}
+		q.Kinds = kinds
+	}
+
+	if c.QueryParam("color") != "" {
+		colors, err := getListItems(cond.Color, c.QueryParam("color"))
+		if err != nil {
+			return nil, fmt.Errorf("color invalid, %v : %v", c.QueryParam("color"), err)
+		}
+		q.Colors = colors
+	}
+
+	if c.QueryParam("features") != "" {
+		features, err := getListItems(cond.Feature, c.QueryParam("features"))
+		if err != nil {
+			return nil, fmt.Errorf("features invalid, %v : %v", c.QueryParam("features"), err)
+		}
+		q.Features = features
+	}
+
+	return q, nil
+}
+
+func searchChairs(c echo.Context) error {
+	q, err := parseChairQuery(c)
+	if err != nil {
+		goLog.Println(err)
+		c.Echo().Logger.Infof("%v", err)
+		return c.NoContent(http.StatusBadRequest)
+	}
+
+	if !q.HasCondition() {
+		c.Echo().Logger.Infof("Search condition not found")
+		return c.NoContent(http.StatusBadRequest)
+	}
+
+	order, err := findOrder(chairOrders, c.QueryParam("sort"))
+	if err != nil {
+		goLog.Println(err)
+		c.Logger().Infof("Invalid sort parameter : %v", err)
+		return c.NoContent(http.StatusBadRequest)
+	}
+
+	// cursor があれば page の代わりにその続きから返す
+	var after *searchCursor
+	if c.QueryParam("cursor") != "" {
+		after, err = decodeSearchCursor(c.QueryParam("cursor"))
+		if err != nil {
+			goLog.Println(err)
+			c.Logger().Infof("Invalid format cursor parameter : %v", err)
+			return c.NoContent(http.StatusBadRequest)
+		}
+		if after.Order != order.Name {
+			c.Logger().Infof("cursor is for sort %q, not %q", after.Order, order.Name)
+			return c.NoContent(http.StatusBadRequest)
 		}
+	}
+
+	page, perPage, err := parsePagination(c, after != nil)
+	if err != nil {
+		goLog.Println(err)
+		c.Logger().Infof("%v", err)
+		return c.NoContent(http.StatusBadRequest)
+	}
+
+	withFacets := c.QueryParam("facets") == "true"
+	key := fmt.Sprintf("%s/%s/%s/%d/%d/%v", q.Key(), order.Name, c.QueryParam("cursor"), page, perPage, withFacets)
+	cached, gen, ok := chairSearchCache.Get(key)
+	if ok {
+		return c.JSON(http.StatusOK, cached)
+	}
+
+	var res ChairSearchResponse
+	var next *searchCursor
+	if searchCountStrategy == countByWindow {
+		res.Count, res.Chairs, next, err = searchChairsByWindow(q, order, after, page*perPage, perPage)
+		if err != nil {
+			goLog.Println(err)
+			c.Logger().Errorf("searchChairs DB execution error : %v", err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+	} else {
+		res.Count, res.Chairs, next = chairIdx.Search(q, order, after, page*perPage, perPage)
+	}
+	if next != nil {
+		res.NextCursor = next.Encode()
+	}
+	if withFacets {
+		facets := chairIdx.Facets(q)
+		res.Facets = &facets
+	}
+	match := q.Match
+	if withFacets {
+		match = q.MatchFacets
+	}
+	chairSearchCache.Set(key, gen, func(v interface{}) bool { return match(v.(*Chair)) }, res)
+
+	return c.JSON(http.StatusOK, res)
+}
+
+func exportChairs(c echo.Context) error {
+	q, err := parseChairQuery(c)
+	if err != nil {
+		goLog.Println(err)
+		c.Echo().Logger.Infof("%v", err)
+		return c.NoContent(http.StatusBadRequest)
+	}
+
+	chairs := chairIdx.Export(q)
+	return writeCSV(c, "chairs.csv", chairCSVColumns, c.QueryParam("header") == "true", len(chairs), func(i int) interface{} {
+		return chairs[i]
+	})
+}
+
+// * score
+func buyChair(c echo.Context) error {
+	var req BuyChairRequest
+	if err := c.Echo().JSONSerializer.Deserialize(c, &req); err != nil {
+		c.Echo().Logger.Infof("post buy chair failed : %v", err)
+		return c.JSON(http.StatusBadRequest, newRequestBodyError(err))
+	}
+
+	if err := validateEmail(req.Email); err != nil {
+		c.Echo().Logger.Infof("post buy chair failed : %v", err)
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Message: err.Error()})
+	}
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		goLog.Println(err)
+		c.Echo().Logger.Infof("post buy chair failed : %v", err)
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Message: "invalid chair id"})
+	}
+
+	// DecrStock がコミットと同じ順に効くよう在庫の変更と並べる
+	defer chairLocks.Lock(int64(id))()
+
+	tx, err := db.Beginx()
+	if err != nil {
+		goLog.Println(err)
+		c.Echo().Logger.Errorf("failed to create transaction : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("UPDATE chair SET stock = stock - 1 WHERE id = ? AND stock > 0", id)
+	if err != nil {
+		goLog.Println(err)
+		c.Echo().Logger.Errorf("chair stock update failed : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
 		goLog.Println(err)
 		c.Echo().Logger.Errorf("chair stock update failed : %v", err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
+	if affected == 0 {
+		var stock int64
+		err = tx.Get(&stock, "SELECT stock FROM chair WHERE id = ?", id)
+		if err == sql.ErrNoRows {
+			c.Echo().Logger.Infof("buyChair chair id \"%v\" not found", id)
+			return c.JSON(http.StatusNotFound, ErrorResponse{Message: "chair not found"})
+		}
+		if err != nil {
+			goLog.Println(err)
+			c.Echo().Logger.Errorf("DB Execution Error: on getting a chair by id : %v", err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		// 売り切れの椅子も存在しない椅子と同様に 404 を返す仕様
+		c.Echo().Logger.Infof("buyChair chair id \"%v\" is sold out", id)
+		return c.JSON(http.StatusNotFound, ErrorResponse{Message: "chair is sold out"})
+	}
+
+	_, err = tx.Exec("INSERT INTO purchases(chair_id, email, user_agent, remote_addr) VALUES (?, ?, ?, ?)", id, req.Email, c.Request().UserAgent(), c.RealIP())
+	if err != nil {
+		goLog.Println(err)
+		c.Echo().Logger.Errorf("failed to insert purchase : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
 
-	// err = tx.Commit()
-	// if err != nil {
-	// 	goLog.Println(err)
-	// 	c.Echo().Logger.Errorf("transaction commit error : %v", err)
-	// 	return c.NoContent(http.StatusInternalServerError)
-	// }
+	err = tx.Commit()
+	if err != nil {
+		goLog.Println(err)
+		c.Echo().Logger.Errorf("transaction commit error : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	stock := chairIdx.DecrStock(int64(id))
+	if stock <= 0 {
+		omLowPriceChair.Delete(int64(id))
+	}
 
 	return c.NoContent(http.StatusOK)
 }
 
+func getChairPurchases(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		goLog.Println(err)
+		c.Echo().Logger.Infof("Request parameter \"id\" parse error : %v", err)
+		return c.NoContent(http.StatusBadRequest)
+	}
+
+	purchases := []Purchase{}
+	err = db.Select(&purchases, "SELECT * FROM purchases WHERE chair_id = ? ORDER BY created_at DESC, id DESC", id)
+	if err != nil {
+		goLog.Println(err)
+		c.Logger().Errorf("getChairPurchases DB execution error : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.JSON(http.StatusOK, PurchaseListResponse{Purchases: purchases})
+}
+
 func getChairSearchCondition(c echo.Context) error {
-	return c.JSON(http.StatusOK, chairSearchCondition)
+	return c.JSON(http.StatusOK, currentChairSearchCondition())
 }
 
 func getLowPricedChair(c echo.Context) error {
@@ -754,7 +1488,7 @@ func getLowPricedChair(c echo.Context) error {
 	// 	return c.NoContent(http.StatusInternalServerError)
 	// }
 
-	chairs := omLowPriceChair.Get()
+	chairs := omLowPriceChair.Snapshot().([]Chair)
 	return c.JSON(http.StatusOK, ChairListResponse{Chairs: chairs})
 }
 
@@ -795,6 +1529,17 @@ func getRange(cond RangeCondition, rangeID string) (*Range, error) {
 	return cond.Ranges[RangeIndex], nil
 }
 
+// getListItems カンマ区切りの値を cond.List で検証し, 重複のない値の集合を返す
+func getListItems(cond ListCondition, values string) ([]string, error) {
+	tokens := splitFeatures(values)
+	for _, v := range tokens {
+		if !containsString(cond.List, v) {
+			return nil, fmt.Errorf("Unexpected value: %s", v)
+		}
+	}
+	return tokens, nil
+}
+
 func postEstate(c echo.Context) error {
 	header, err := c.FormFile("estates")
 	if err != nil {
@@ -809,167 +1554,403 @@ func postEstate(c echo.Context) error {
 		return c.NoContent(http.StatusInternalServerError)
 	}
 	defer f.Close()
-	records, err := csv.NewReader(f).ReadAll()
+
+	dryRun := c.FormValue("dryRun") == "true"
+	hasHeader := c.FormValue("header") == "true"
+	onInvalid := c.FormValue("onInvalid")
+	if onInvalid != "" && onInvalid != "reject" && onInvalid != "skip" {
+		c.Logger().Infof("onInvalid invalid : %v", onInvalid)
+		return c.NoContent(http.StatusBadRequest)
+	}
+	mode := c.FormValue("mode")
+	if mode == "" {
+		mode = importInsert
+	}
+	if mode != importInsert && mode != importUpsert && mode != importReplace {
+		c.Logger().Infof("mode invalid : %v", mode)
+		return c.NoContent(http.StatusBadRequest)
+	}
+
+	tx, err := db.Beginx()
 	if err != nil {
 		goLog.Println(err)
-		c.Logger().Errorf("failed to read csv: %v", err)
+		c.Logger().Errorf("failed to begin tx: %v", err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
-
-	args := make([]interface{}, 0, len(records)*13)
-	placeHolders := &strings.Builder{}
-	for i, row := range records {
-		rm := RecordMapper{Record: row}
-		id := rm.NextInt()
-		name := rm.NextString()
-		description := rm.NextString()
-		thumbnail := rm.NextString()
-		address := rm.NextString()
-		latitude := rm.NextFloat()
-		longitude := rm.NextFloat()
-		rent := rm.NextInt()
-		doorHeight := rm.NextInt()
-		doorWidth := rm.NextInt()
-		features := rm.NextString()
-		popularity := rm.NextInt()
-		if err := rm.Err(); err != nil {
-			c.Logger().Errorf("failed to read record: %v", err)
-			return c.NoContent(http.StatusBadRequest)
+	defer tx.Rollback()
+
+	query, suffix := importStatement(mode, "estate",
+		[]string{"id", "name", "description", "thumbnail", "address", "latitude", "longitude", "rent", "door_height", "door_width", "features", "popularity", "popularity_desc", "geom", "created_at"},
+		[]string{"name", "description", "thumbnail", "address", "latitude", "longitude", "rent", "door_height", "door_width", "features", "popularity", "geom"})
+	inserter := newBulkInserter(tx, query, "(?,?,?,?,?,?,?,?,?,?,?,?,null,ST_PointFromText(?),?)", suffix, csvChunkSize)
+	// 既存の行は created_at を更新しないので, 新しく入る行だけがこの日時になる
+	now := time.Now().UTC().Truncate(time.Microsecond)
+	estates := make([]Estate, 0)
+	report := newCSVImportReport()
+	seen := make(map[int64]bool)
+	columns := estateCSVColumns
+	r := csv.NewReader(f)
+	r.ReuseRecord = true
+	r.FieldsPerRecord = -1
+	for row := 1; ; row++ {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
 		}
-		geom := fmt.Sprintf("POINT(%f %f)", latitude, longitude)
-		args = append(args, []interface{}{id, name, description, thumbnail, address, latitude, longitude, rent, doorHeight, doorWidth, features, popularity, geom}...)
-		if i == 0 {
-			placeHolders.WriteString(" (?,?,?,?,?,?,?,?,?,?,?,?,null,ST_PointFromText(?))")
-		} else {
-			placeHolders.WriteString(",(?,?,?,?,?,?,?,?,?,?,?,?,null,ST_PointFromText(?))")
+		if err != nil {
+			// クォートの崩れなどがあると以降の行は読めないのでファイルごと拒否する
+			goLog.Println(err)
+			c.Logger().Infof("failed to read csv: %v", err)
+			report.Add(row, []*RecordError{{Reason: err.Error()}})
+			return c.JSON(http.StatusBadRequest, report)
+		}
+		if hasHeader && row == 1 {
+			columns = normalizeCSVHeader(record)
+			if errs := checkCSVHeader(columns, estateCSVColumns); len(errs) > 0 {
+				c.Logger().Infof("invalid csv header : %v", errs[0])
+				report.Add(row, errs)
+				return c.JSON(http.StatusBadRequest, report)
+			}
+			continue
 		}
+		rm := RecordMapper{Record: record, Columns: columns}
+		var estate Estate
+		rm.Decode(&estate)
+		estate.Features = normalizeFeatures(estate.Features)
+		errs := rm.Errors()
+		if len(errs) == 0 {
+			errs = validateEstate(estate, seen, mode)
+		}
+		if len(errs) > 0 {
+			report.Add(row, errs)
+			continue
+		}
+		seen[estate.ID] = true
+		report.Valid++
+		if dryRun || (report.Invalid > 0 && onInvalid != "skip") {
+			continue
+		}
+		geom := fmt.Sprintf("POINT(%f %f)", estate.Latitude, estate.Longitude)
+		if err := inserter.Add(estate.ID, estate.Name, estate.Description, estate.Thumbnail, estate.Address, estate.Latitude, estate.Longitude, estate.Rent, estate.DoorHeight, estate.DoorWidth, estate.Features, estate.Popularity, geom, now); err != nil {
+			goLog.Println(err)
+			c.Logger().Errorf("failed to insert estate: %v", err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		estate.CreatedAt = now
+		estates = append(estates, estate)
 	}
-	_, err = db.Exec("INSERT INTO estate(id, name, description, thumbnail, address, latitude, longitude, rent, door_height, door_width, features, popularity, popularity_desc, geom) VALUES"+placeHolders.String(), args...)
-	if err != nil {
+	if report.Invalid > 0 {
+		c.Logger().Infof("invalid estate records : %v", report.Invalid)
+		if onInvalid != "skip" {
+			return c.JSON(http.StatusBadRequest, report)
+		}
+	}
+	if dryRun {
+		return c.JSON(http.StatusOK, report)
+	}
+	if err := inserter.Flush(); err != nil {
 		goLog.Println(err)
 		c.Logger().Errorf("failed to insert estate: %v", err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
+	if mode == importReplace {
+		ids := make([]int64, len(estates))
+		for i := range estates {
+			ids[i] = estates[i].ID
+		}
+		if report.Deleted, err = deleteMissing(tx, "estate", ids); err != nil {
+			goLog.Println(err)
+			c.Logger().Errorf("failed to delete estates: %v", err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		goLog.Println(err)
+		c.Logger().Errorf("failed to commit tx: %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
 
-	var estates []Estate
-	db.Select(&estates, "SELECT * FROM estate ORDER BY rent ASC, id ASC LIMIT ?", Limit)
-	omLowPriceEstate.Set(estates)
+	if mode == importReplace {
+		// 消した行もあるのでインデックスとキャッシュを DB から作り直す
+		if err := loadEstateIndex(); err != nil {
+			goLog.Println(err)
+			c.Logger().Errorf("failed to load estate index : %v", err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+		report.Imported = len(estates)
+		return c.JSON(http.StatusCreated, report)
+	}
 
-	return c.NoContent(http.StatusCreated)
+	estateIdx.Put(estates)
+	for _, estate := range estates {
+		omLowPriceEstate.Upsert(estate)
+	}
+
+	report.Imported = len(estates)
+	return c.JSON(http.StatusCreated, report)
 }
 
-func searchEstates(c echo.Context) error {
-	conditions := make([]string, 0)
-	params := make([]interface{}, 0)
+func putEstate(c echo.Context) error {
+	return updateEstate(c, false)
+}
+
+func patchEstate(c echo.Context) error {
+	return updateEstate(c, true)
+}
+
+// updateEstate ボディの内容で物件を置き換える. partial なら既存の値にボディにある項目だけを上書きする
+func updateEstate(c echo.Context, partial bool) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		goLog.Println(err)
+		c.Echo().Logger.Infof("Request parameter \"id\" parse error : %v", err)
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Message: "invalid estate id"})
+	}
+
+	// 行をロックしてから遅いクライアントを待たないよう, ボディは先に読み切っておく
+	raw, err := io.ReadAll(c.Request().Body)
+	if err != nil {
+		goLog.Println(err)
+		c.Echo().Logger.Infof("update estate failed : %v", err)
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Message: "invalid request body"})
+	}
+
+	// 他の更新と入れ違いにインデックスを古い値で上書きしないよう, コミットとインデックスの更新を id ごとに並べる
+	defer estateLocks.Lock(int64(id))()
+
+	tx, err := db.Beginx()
+	if err != nil {
+		goLog.Println(err)
+		c.Echo().Logger.Errorf("failed to create transaction : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	defer tx.Rollback()
+
+	var current Estate
+	err = tx.Get(&current, "SELECT * FROM estate WHERE id = ? FOR UPDATE", id)
+	if err == sql.ErrNoRows {
+		c.Echo().Logger.Infof("updateEstate estate id \"%v\" not found", id)
+		return c.JSON(http.StatusNotFound, ErrorResponse{Message: "estate not found"})
+	}
+	if err != nil {
+		goLog.Println(err)
+		c.Echo().Logger.Errorf("DB Execution Error: on getting an estate by id : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	var body EstateBody
+	if partial {
+		body = newEstateBody(current)
+	}
+	c.Request().Body = io.NopCloser(bytes.NewReader(raw))
+	if err := c.Echo().JSONSerializer.Deserialize(c, &body); err != nil {
+		c.Echo().Logger.Infof("update estate failed : %v", err)
+		return c.JSON(http.StatusBadRequest, newRequestBodyError(err))
+	}
+	estate := body.toEstate(current.ID)
+	if errs := validateEstate(estate, map[int64]bool{}, importUpsert); len(errs) > 0 {
+		c.Echo().Logger.Infof("update estate failed : %v", errs[0])
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Message: errs[0].Error()})
+	}
+
+	geom := fmt.Sprintf("POINT(%f %f)", estate.Latitude, estate.Longitude)
+	_, err = tx.Exec("UPDATE estate SET name = ?, description = ?, thumbnail = ?, address = ?, latitude = ?, longitude = ?, rent = ?, door_height = ?, door_width = ?, features = ?, popularity = ?, geom = ST_PointFromText(?) WHERE id = ?",
+		estate.Name, estate.Description, estate.Thumbnail, estate.Address, estate.Latitude, estate.Longitude, estate.Rent, estate.DoorHeight, estate.DoorWidth, estate.Features, estate.Popularity, geom, estate.ID)
+	if err != nil {
+		goLog.Println(err)
+		c.Echo().Logger.Errorf("estate update failed : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if err := tx.Commit(); err != nil {
+		goLog.Println(err)
+		c.Echo().Logger.Errorf("transaction commit error : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	estateIdx.Put([]Estate{estate})
+	omLowPriceEstate.Upsert(estate)
+
+	return c.JSON(http.StatusOK, newEstateBody(estate))
+}
+
+func deleteEstate(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		goLog.Println(err)
+		c.Echo().Logger.Infof("Request parameter \"id\" parse error : %v", err)
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Message: "invalid estate id"})
+	}
+
+	defer estateLocks.Lock(int64(id))()
+	result, err := db.Exec("DELETE FROM estate WHERE id = ?", id)
+	if err != nil {
+		goLog.Println(err)
+		c.Echo().Logger.Errorf("estate delete failed : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		goLog.Println(err)
+		c.Echo().Logger.Errorf("estate delete failed : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if affected == 0 {
+		c.Echo().Logger.Infof("deleteEstate estate id \"%v\" not found", id)
+		return c.JSON(http.StatusNotFound, ErrorResponse{Message: "estate not found"})
+	}
+
+	estateIdx.Delete(int64(id))
+	omLowPriceEstate.Delete(int64(id))
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// parseEstateQuery searchEstates と同じクエリパラメータから検索条件を作る
+func parseEstateQuery(c echo.Context) (*estateQuery, error) {
+	q := newEstateQuery()
+	// 途中で差し替えられても 1 つの検索条件で解釈する
+	cond := currentEstateSearchCondition()
 
 	if c.QueryParam("doorHeightRangeId") != "" {
-		doorHeight, err := getRange(estateSearchCondition.DoorHeight, c.QueryParam("doorHeightRangeId"))
+		r, err := getRange(cond.DoorHeight, c.QueryParam("doorHeightRangeId"))
 		if err != nil {
-			goLog.Println(err)
-			c.Echo().Logger.Infof("doorHeightRangeID invalid, %v : %v", c.QueryParam("doorHeightRangeId"), err)
-			return c.NoContent(http.StatusBadRequest)
-		}
-
-		if doorHeight.Min != -1 {
-			conditions = append(conditions, "door_height >= ?")
-			params = append(params, doorHeight.Min)
-		}
-		if doorHeight.Max != -1 {
-			conditions = append(conditions, "door_height < ?")
-			params = append(params, doorHeight.Max)
+			return nil, fmt.Errorf("doorHeightRangeID invalid, %v : %v", c.QueryParam("doorHeightRangeId"), err)
 		}
+		q.DoorHeightRange = r
 	}
 
 	if c.QueryParam("doorWidthRangeId") != "" {
-		doorWidth, err := getRange(estateSearchCondition.DoorWidth, c.QueryParam("doorWidthRangeId"))
+		r, err := getRange(cond.DoorWidth, c.QueryParam("doorWidthRangeId"))
 		if err != nil {
-			goLog.Println(err)
-			c.Echo().Logger.Infof("doorWidthRangeID invalid, %v : %v", c.QueryParam("doorWidthRangeId"), err)
-			return c.NoContent(http.StatusBadRequest)
-		}
-
-		if doorWidth.Min != -1 {
-			conditions = append(conditions, "door_width >= ?")
-			params = append(params, doorWidth.Min)
-		}
-		if doorWidth.Max != -1 {
-			conditions = append(conditions, "door_width < ?")
-			params = append(params, doorWidth.Max)
+			return nil, fmt.Errorf("doorWidthRangeID invalid, %v : %v", c.QueryParam("doorWidthRangeId"), err)
 		}
+		q.DoorWidthRange = r
 	}
 
 	if c.QueryParam("rentRangeId") != "" {
-		estateRent, err := getRange(estateSearchCondition.Rent, c.QueryParam("rentRangeId"))
+		r, err := getRange(cond.Rent, c.QueryParam("rentRangeId"))
 		if err != nil {
-			goLog.Println(err)
-			c.Echo().Logger.Infof("rentRangeID invalid, %v : %v", c.QueryParam("rentRangeId"), err)
-			return c.NoContent(http.StatusBadRequest)
-		}
-
-		if estateRent.Min != -1 {
-			conditions = append(conditions, "rent >= ?")
-			params = append(params, estateRent.Min)
+			return nil, fmt.Errorf("rentRangeID invalid, %v : %v", c.QueryParam("rentRangeId"), err)
 		}
-		if estateRent.Max != -1 {
-			conditions = append(conditions, "rent < ?")
-			params = append(params, estateRent.Max)
+		q.RentRange = r
+	}
+
+	for _, b := range []struct {
+		name string
+		dst  *bounds
+		max  int64
+	}{
+		{"doorHeight", &q.DoorHeight, maxTinyIntUnsigned},
+		{"doorWidth", &q.DoorWidth, maxTinyIntUnsigned},
+		{"rent", &q.Rent, maxMediumInt},
+	} {
+		v, err := parseBounds(c, b.name, b.max)
+		if err != nil {
+			return nil, err
 		}
+		*b.dst = v
 	}
 
 	if c.QueryParam("features") != "" {
-		for _, f := range strings.Split(c.QueryParam("features"), ",") {
-			conditions = append(conditions, "features like concat('%', ?, '%')")
-			params = append(params, f)
+		features, err := getListItems(cond.Feature, c.QueryParam("features"))
+		if err != nil {
+			return nil, fmt.Errorf("features invalid, %v : %v", c.QueryParam("features"), err)
 		}
+		q.Features = features
+	}
+
+	return q, nil
+}
+
+func searchEstates(c echo.Context) error {
+	q, err := parseEstateQuery(c)
+	if err != nil {
+		goLog.Println(err)
+		c.Echo().Logger.Infof("%v", err)
+		return c.NoContent(http.StatusBadRequest)
 	}
 
-	if len(conditions) == 0 {
+	if !q.HasCondition() {
 		c.Echo().Logger.Infof("searchEstates search condition not found")
 		return c.NoContent(http.StatusBadRequest)
 	}
 
-	page, err := strconv.Atoi(c.QueryParam("page"))
+	order, err := findOrder(estateOrders, c.QueryParam("sort"))
 	if err != nil {
 		goLog.Println(err)
-		c.Logger().Infof("Invalid format page parameter : %v", err)
+		c.Logger().Infof("Invalid sort parameter : %v", err)
 		return c.NoContent(http.StatusBadRequest)
 	}
 
-	perPage, err := strconv.Atoi(c.QueryParam("perPage"))
+	// cursor があれば page の代わりにその続きから返す
+	var after *searchCursor
+	if c.QueryParam("cursor") != "" {
+		after, err = decodeSearchCursor(c.QueryParam("cursor"))
+		if err != nil {
+			goLog.Println(err)
+			c.Logger().Infof("Invalid format cursor parameter : %v", err)
+			return c.NoContent(http.StatusBadRequest)
+		}
+		if after.Order != order.Name {
+			c.Logger().Infof("cursor is for sort %q, not %q", after.Order, order.Name)
+			return c.NoContent(http.StatusBadRequest)
+		}
+	}
+
+	page, perPage, err := parsePagination(c, after != nil)
 	if err != nil {
 		goLog.Println(err)
-		c.Logger().Infof("Invalid format perPage parameter : %v", err)
+		c.Logger().Infof("%v", err)
 		return c.NoContent(http.StatusBadRequest)
 	}
 
-	searchQuery := "SELECT * FROM estate WHERE "
-	countQuery := "SELECT COUNT(*) FROM estate WHERE "
-	searchCondition := strings.Join(conditions, " AND ")
-	limitOffset := " ORDER BY popularity_desc, id ASC LIMIT ? OFFSET ?"
+	withFacets := c.QueryParam("facets") == "true"
+	key := fmt.Sprintf("%s/%s/%s/%d/%d/%v", q.Key(), order.Name, c.QueryParam("cursor"), page, perPage, withFacets)
+	cached, gen, ok := estateSearchCache.Get(key)
+	if ok {
+		return c.JSON(http.StatusOK, cached)
+	}
 
 	var res EstateSearchResponse
-	err = db.Get(&res.Count, countQuery+searchCondition, params...)
-	if err != nil {
-		goLog.Println(err)
-		c.Logger().Errorf("searchEstates DB execution error : %v", err)
-		return c.NoContent(http.StatusInternalServerError)
+	var next *searchCursor
+	if searchCountStrategy == countByWindow {
+		res.Count, res.Estates, next, err = searchEstatesByWindow(q, order, after, page*perPage, perPage)
+		if err != nil {
+			goLog.Println(err)
+			c.Logger().Errorf("searchEstates DB execution error : %v", err)
+			return c.NoContent(http.StatusInternalServerError)
+		}
+	} else {
+		res.Count, res.Estates, next = estateIdx.Search(q, order, after, page*perPage, perPage)
 	}
+	if next != nil {
+		res.NextCursor = next.Encode()
+	}
+	if withFacets {
+		facets := estateIdx.Facets(q)
+		res.Facets = &facets
+	}
+	match := q.Match
+	if withFacets {
+		match = q.MatchFacets
+	}
+	estateSearchCache.Set(key, gen, func(v interface{}) bool { return match(v.(*Estate)) }, res)
+
+	return c.JSON(http.StatusOK, res)
+}
 
-	estates := []Estate{}
-	params = append(params, perPage, page*perPage)
-	err = db.Select(&estates, searchQuery+searchCondition+limitOffset, params...)
+func exportEstates(c echo.Context) error {
+	q, err := parseEstateQuery(c)
 	if err != nil {
 		goLog.Println(err)
-		if err == sql.ErrNoRows {
-			return c.JSON(http.StatusOK, EstateSearchResponse{Count: 0, Estates: []Estate{}})
-		}
-		c.Logger().Errorf("searchEstates DB execution error : %v", err)
-		return c.NoContent(http.StatusInternalServerError)
+		c.Echo().Logger.Infof("%v", err)
+		return c.NoContent(http.StatusBadRequest)
 	}
 
-	res.Estates = estates
-
-	return c.JSON(http.StatusOK, res)
+	estates := estateIdx.Export(q)
+	return writeCSV(c, "estates.csv", estateCSVColumns, c.QueryParam("header") == "true", len(estates), func(i int) interface{} {
+		return estates[i]
+	})
 }
 
 func getLowPricedEstate(c echo.Context) error {
@@ -985,7 +1966,7 @@ func getLowPricedEstate(c echo.Context) error {
 	// 	c.Logger().Errorf("getLowPricedEstate DB execution error : %v", err)
 	// 	return c.NoContent(http.StatusInternalServerError)
 	// }
-	estates := omLowPriceEstate.Get()
+	estates := omLowPriceEstate.Snapshot().([]Estate)
 	return c.JSON(http.StatusOK, EstateListResponse{Estates: estates})
 }
 
@@ -997,6 +1978,13 @@ func searchRecommendedEstateWithChair(c echo.Context) error {
 		return c.NoContent(http.StatusBadRequest)
 	}
 
+	order, err := findOrder(estateOrders, c.QueryParam("sort"))
+	if err != nil {
+		goLog.Println(err)
+		c.Logger().Infof("Invalid sort parameter : %v", err)
+		return c.NoContent(http.StatusBadRequest)
+	}
+
 	chair := Chair{}
 	query := `SELECT * FROM chair WHERE id = ?`
 	err = db.Get(&chair, query, id)
@@ -1014,7 +2002,7 @@ func searchRecommendedEstateWithChair(c echo.Context) error {
 	w := chair.Width
 	h := chair.Height
 	d := chair.Depth
-	query = `SELECT * FROM estate WHERE (door_width >= ? AND door_height >= ?) OR (door_width >= ? AND door_height >= ?) OR (door_width >= ? AND door_height >= ?) OR (door_width >= ? AND door_height >= ?) OR (door_width >= ? AND door_height >= ?) OR (door_width >= ? AND door_height >= ?) ORDER BY popularity_desc, id ASC LIMIT ?`
+	query = `SELECT * FROM estate WHERE (door_width >= ? AND door_height >= ?) OR (door_width >= ? AND door_height >= ?) OR (door_width >= ? AND door_height >= ?) OR (door_width >= ? AND door_height >= ?) OR (door_width >= ? AND door_height >= ?) OR (door_width >= ? AND door_height >= ?) ORDER BY ` + order.orderBy() + ` LIMIT ?`
 	err = db.Select(&estates, query, w, h, w, d, h, w, h, d, d, w, d, h, Limit)
 	if err != nil {
 		goLog.Println(err)
@@ -1096,23 +2084,22 @@ func searchEstateNazotte(c echo.Context) error {
 
 // * score
 func postEstateRequestDocument(c echo.Context) error {
-	m := echo.Map{}
-	if err := c.Bind(&m); err != nil {
+	var req RequestDocumentRequest
+	if err := c.Echo().JSONSerializer.Deserialize(c, &req); err != nil {
 		c.Echo().Logger.Infof("post request document failed : %v", err)
-		return c.NoContent(http.StatusInternalServerError)
+		return c.JSON(http.StatusBadRequest, newRequestBodyError(err))
 	}
 
-	_, ok := m["email"].(string)
-	if !ok {
-		c.Echo().Logger.Info("post request document failed : email not found in request body")
-		return c.NoContent(http.StatusBadRequest)
+	if err := validateEmail(req.Email); err != nil {
+		c.Echo().Logger.Infof("post request document failed : %v", err)
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Message: err.Error()})
 	}
 
 	id, err := strconv.Atoi(c.Param("id"))
 	if err != nil {
 		goLog.Println(err)
 		c.Echo().Logger.Infof("post request document failed : %v", err)
-		return c.NoContent(http.StatusBadRequest)
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Message: "invalid estate id"})
 	}
 
 	estate := Estate{}
@@ -1121,17 +2108,43 @@ func postEstateRequestDocument(c echo.Context) error {
 	if err != nil {
 		goLog.Println(err)
 		if err == sql.ErrNoRows {
-			return c.NoContent(http.StatusNotFound)
+			return c.JSON(http.StatusNotFound, ErrorResponse{Message: "estate not found"})
 		}
 		c.Logger().Errorf("postEstateRequestDocument DB execution error : %v", err)
 		return c.NoContent(http.StatusInternalServerError)
 	}
 
+	_, err = db.Exec("INSERT INTO document_requests(estate_id, email, user_agent, remote_addr) VALUES (?, ?, ?, ?)", id, req.Email, c.Request().UserAgent(), c.RealIP())
+	if err != nil {
+		goLog.Println(err)
+		c.Logger().Errorf("failed to insert document request : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
 	return c.NoContent(http.StatusOK)
 }
 
+func getEstateDocumentRequests(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		goLog.Println(err)
+		c.Echo().Logger.Infof("Request parameter \"id\" parse error : %v", err)
+		return c.NoContent(http.StatusBadRequest)
+	}
+
+	requests := []DocumentRequest{}
+	err = db.Select(&requests, "SELECT * FROM document_requests WHERE estate_id = ? ORDER BY created_at DESC, id DESC", id)
+	if err != nil {
+		goLog.Println(err)
+		c.Logger().Errorf("getEstateDocumentRequests DB execution error : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+
+	return c.JSON(http.StatusOK, DocumentRequestListResponse{Requests: requests})
+}
+
 func getEstateSearchCondition(c echo.Context) error {
-	return c.JSON(http.StatusOK, estateSearchCondition)
+	return c.JSON(http.StatusOK, currentEstateSearchCondition())
 }
 
 func (cs Coordinates) getBoundingBox() BoundingBox {
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// searchCacheMaxEntries これを超えたらキャッシュを空にする
+const searchCacheMaxEntries = 10000
+
+// searchCacheMaxInvalidate 1 度に変わった行がこれより多ければエントリを調べずにキャッシュを空にする
+const searchCacheMaxInvalidate = 16
+
+// searchCache 検索条件ごとの検索レスポンスのキャッシュ.
+// 行が変わったときはその行 (変更前と変更後) に一致する条件のエントリだけを捨てる
+type searchCache struct {
+	mu      sync.Mutex
+	entries map[string]searchCacheEntry
+	// gen Invalidate のたびに増える. 検索中に変更があった結果は Set しない
+	gen uint64
+}
+
+type searchCacheEntry struct {
+	match func(v interface{}) bool
+	res   interface{}
+}
+
+var chairSearchCache = newSearchCache()
+var estateSearchCache = newSearchCache()
+
+func newSearchCache() *searchCache {
+	return &searchCache{entries: map[string]searchCacheEntry{}}
+}
+
+// Get キャッシュされたレスポンスと, 未キャッシュなら Set に渡す世代を返す
+func (sc *searchCache) Get(key string) (interface{}, uint64, bool) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	e, ok := sc.entries[key]
+	return e.res, sc.gen, ok
+}
+
+// Set gen は検索前に Get で得た世代. その後に変更があれば捨てる
+func (sc *searchCache) Set(key string, gen uint64, match func(v interface{}) bool, res interface{}) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	if gen != sc.gen {
+		return
+	}
+	if len(sc.entries) >= searchCacheMaxEntries {
+		sc.entries = map[string]searchCacheEntry{}
+	}
+	sc.entries[key] = searchCacheEntry{match: match, res: res}
+}
+
+// Invalidate vs のどれかに一致する条件のエントリを 1 度の走査で捨てる
+func (sc *searchCache) Invalidate(vs ...interface{}) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.gen++
+	if len(vs) > searchCacheMaxInvalidate {
+		sc.entries = map[string]searchCacheEntry{}
+		return
+	}
+	for key, e := range sc.entries {
+		for _, v := range vs {
+			if e.match(v) {
+				delete(sc.entries, key)
+				break
+			}
+		}
+	}
+}
+
+func (sc *searchCache) Clear() {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	sc.gen++
+	sc.entries = map[string]searchCacheEntry{}
+}
+
+// sortedList 指定順に依らないキーにするため並べ替えた値の一覧
+func sortedList(values []string) string {
+	vs := make([]string, len(values))
+	copy(vs, values)
+	sort.Strings(vs)
+	return strings.Join(vs, ",")
+}
+
+// rangeKey 検索条件の差し替え前後で ID が同じでも範囲が違えば別のキーにする
+func rangeKey(r *Range) string {
+	if r == nil {
+		return "-"
+	}
+	return fmt.Sprintf("%d:%d", r.Min, r.Max)
+}
+
+// matchRange r が nil なら常に一致する
+func matchRange(r *Range, v int64) bool {
+	return r == nil || inRange(r, v)
+}
+
+// Key 同じ検索結果になる条件が同じ文字列になるように正規化したキー
+func (q *chairQuery) Key() string {
+	return fmt.Sprintf("%s/%s/%s/%s/%v/%v/%v/%v/%q/%q/%q", rangeKey(q.PriceRange), rangeKey(q.HeightRange), rangeKey(q.WidthRange), rangeKey(q.DepthRange),
+		q.Price, q.Height, q.Width, q.Depth, sortedList(q.Kinds), sortedList(q.Colors), sortedList(q.Features))
+}
+
+// Match 椅子が q の検索結果に含まれるか. chairIndex.filter と同じ判定をする
+func (q *chairQuery) Match(chair *Chair) bool {
+	if chair.Stock <= 0 {
+		return false
+	}
+	if !matchRange(q.PriceRange, chair.Price) {
+		return false
+	}
+	if !matchRange(q.HeightRange, chair.Height) {
+		return false
+	}
+	if !matchRange(q.WidthRange, chair.Width) {
+		return false
+	}
+	if !matchRange(q.DepthRange, chair.Depth) {
+		return false
+	}
+	if !q.inBounds(chair) {
+		return false
+	}
+	if len(q.Kinds) > 0 && !containsString(q.Kinds, chair.Kind) {
+		return false
+	}
+	if len(q.Colors) > 0 && !containsString(q.Colors, chair.Color) {
+		return false
+	}
+	return hasFeatures(chair.Features, q.Features)
+}
+
+// MatchFacets 椅子が q の Facets の件数に数えられるか. Facets は次元ごとに選択を外して数えるので,
+// そのどれかの条件に一致すれば件数が変わりうる
+func (q *chairQuery) MatchFacets(chair *Chair) bool {
+	for _, clear := range []func(q *chairQuery){
+		func(q *chairQuery) { q.PriceRange = nil },
+		func(q *chairQuery) { q.HeightRange = nil },
+		func(q *chairQuery) { q.WidthRange = nil },
+		func(q *chairQuery) { q.DepthRange = nil },
+		func(q *chairQuery) { q.Colors = nil },
+		func(q *chairQuery) { q.Kinds = nil },
+	} {
+		other := *q
+		clear(&other)
+		if other.Match(chair) {
+			return true
+		}
+	}
+	return false
+}
+
+// Key 同じ検索結果になる条件が同じ文字列になるように正規化したキー
+func (q *estateQuery) Key() string {
+	return fmt.Sprintf("%s/%s/%s/%v/%v/%v/%q", rangeKey(q.DoorHeightRange), rangeKey(q.DoorWidthRange), rangeKey(q.RentRange),
+		q.DoorHeight, q.DoorWidth, q.Rent, sortedList(q.Features))
+}
+
+// Match 物件が q の検索結果に含まれるか. estateIndex.filter と同じ判定をする
+func (q *estateQuery) Match(estate *Estate) bool {
+	if !matchRange(q.DoorHeightRange, estate.DoorHeight) {
+		return false
+	}
+	if !matchRange(q.DoorWidthRange, estate.DoorWidth) {
+		return false
+	}
+	if !matchRange(q.RentRange, estate.Rent) {
+		return false
+	}
+	if !q.inBounds(estate) {
+		return false
+	}
+	return hasFeatures(estate.Features, q.Features)
+}
+
+// MatchFacets 物件が q の Facets の件数に数えられるか
+func (q *estateQuery) MatchFacets(estate *Estate) bool {
+	for _, clear := range []func(q *estateQuery){
+		func(q *estateQuery) { q.DoorHeightRange = nil },
+		func(q *estateQuery) { q.DoorWidthRange = nil },
+		func(q *estateQuery) { q.RentRange = nil },
+	} {
+		other := *q
+		clear(&other)
+		if other.Match(estate) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasFeatures features が want の特徴をすべて持つか
+func hasFeatures(features string, want []string) bool {
+	if len(want) == 0 {
+		return true
+	}
+	have := splitFeatures(features)
+	for _, w := range want {
+		if !containsString(have, w) {
+			return false
+		}
+	}
+	return true
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
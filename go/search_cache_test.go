@@ -0,0 +1,93 @@
+package main
+
+import "testing"
+
+func chairMatcher(q *chairQuery) func(v interface{}) bool {
+	return func(v interface{}) bool { return q.Match(v.(*Chair)) }
+}
+
+// TestSearchCacheInvalidate 変わった行に一致する条件のエントリだけが捨てられるか
+func TestSearchCacheInvalidate(t *testing.T) {
+	sc := newSearchCache()
+	kindA, kindB := newChairQuery(), newChairQuery()
+	kindA.Kinds = []string{"a"}
+	kindB.Kinds = []string{"b"}
+	_, gen, _ := sc.Get("a")
+	sc.Set("a", gen, chairMatcher(kindA), 1)
+	sc.Set("b", gen, chairMatcher(kindB), 2)
+
+	sc.Invalidate(&Chair{ID: 1, Kind: "a", Stock: 1})
+	if _, _, ok := sc.Get("a"); ok {
+		t.Fatal("entry for kind a survived")
+	}
+	if res, _, ok := sc.Get("b"); !ok || res != 2 {
+		t.Fatal("entry for kind b was dropped")
+	}
+
+	// Invalidate の前に Get した世代では Set されない
+	sc.Set("a", gen, chairMatcher(kindA), 1)
+	if _, _, ok := sc.Get("a"); ok {
+		t.Fatal("stale result was cached")
+	}
+}
+
+func TestSearchCacheInvalidateMany(t *testing.T) {
+	sc := newSearchCache()
+	_, gen, _ := sc.Get("a")
+	sc.Set("a", gen, func(v interface{}) bool { return false }, 1)
+	vs := make([]interface{}, searchCacheMaxInvalidate+1)
+	for i := range vs {
+		vs[i] = &Chair{ID: int64(i)}
+	}
+	sc.Invalidate(vs...)
+	if _, _, ok := sc.Get("a"); ok {
+		t.Fatal("cache was not cleared")
+	}
+}
+
+func TestChairQueryKey(t *testing.T) {
+	a, b := newChairQuery(), newChairQuery()
+	a.Kinds = []string{"x", "y"}
+	b.Kinds = []string{"y", "x"}
+	if a.Key() != b.Key() {
+		t.Fatalf("%q != %q", a.Key(), b.Key())
+	}
+	b.PriceRange = &Range{ID: 0, Min: -1, Max: 100}
+	if a.Key() == b.Key() {
+		t.Fatalf("range ignored in %q", a.Key())
+	}
+}
+
+// TestChairQueryMatchFacets 検索結果には入らないが選択を外した件数には数える行で, ファセット付きのエントリを捨てるか
+func TestChairQueryMatchFacets(t *testing.T) {
+	q := newChairQuery()
+	q.PriceRange = &Range{ID: 0, Min: -1, Max: 100}
+	q.Kinds = []string{"a"}
+	otherPrice := &Chair{ID: 1, Kind: "a", Price: 150, Stock: 1}
+	otherKind := &Chair{ID: 2, Kind: "b", Price: 50, Stock: 1}
+	neither := &Chair{ID: 3, Kind: "b", Price: 150, Stock: 1}
+	for _, chair := range []*Chair{otherPrice, otherKind} {
+		if q.Match(chair) || !q.MatchFacets(chair) {
+			t.Fatalf("chair %d: Match %v, MatchFacets %v", chair.ID, q.Match(chair), q.MatchFacets(chair))
+		}
+	}
+	if q.MatchFacets(neither) {
+		t.Fatal("chair outside two dimensions matched")
+	}
+	if q.MatchFacets(&Chair{ID: 4, Kind: "a", Price: 50}) {
+		t.Fatal("sold out chair matched")
+	}
+}
+
+func TestEstateQueryMatchFacets(t *testing.T) {
+	q := newEstateQuery()
+	q.RentRange = &Range{ID: 0, Min: -1, Max: 100}
+	q.Features = []string{"x"}
+	if !q.MatchFacets(&Estate{ID: 1, Rent: 150, Features: "x"}) {
+		t.Fatal("estate in another rent range did not match")
+	}
+	// 特徴は選択を外して数えないので一致しない
+	if q.MatchFacets(&Estate{ID: 2, Rent: 50, Features: "y"}) {
+		t.Fatal("estate without the feature matched")
+	}
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	goLog "log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	chairConditionPath  = "../fixture/chair_condition.json"
+	estateConditionPath = "../fixture/estate_condition.json"
+)
+
+// 検索条件は差し替えのたびに丸ごと作り直して atomic に入れ替える. 読む側は取り出した値を書き換えない
+var chairSearchCondition, estateSearchCondition atomic.Value
+
+// searchConditionMu 読み直しと管理画面からの変更を 1 つずつ行う
+var searchConditionMu sync.Mutex
+
+// search_conditions.target に入る値
+const (
+	chairConditionTarget  = "chair"
+	estateConditionTarget = "estate"
+)
+
+func currentChairSearchCondition() *ChairSearchCondition {
+	return chairSearchCondition.Load().(*ChairSearchCondition)
+}
+
+func currentEstateSearchCondition() *EstateSearchCondition {
+	return estateSearchCondition.Load().(*EstateSearchCondition)
+}
+
+// validateRangeCondition 範囲が ID 順に隙間も重なりもなく並んでいるか. 最初の Min と最後の Max だけ -1 (上限なし) にできる
+func validateRangeCondition(name string, cond RangeCondition) error {
+	if len(cond.Ranges) == 0 {
+		return fmt.Errorf("%s: no ranges", name)
+	}
+	for i, r := range cond.Ranges {
+		if r == nil {
+			return fmt.Errorf("%s: range %d is null", name, i)
+		}
+		if r.ID != int64(i) {
+			return fmt.Errorf("%s: range %d has id %d", name, i, r.ID)
+		}
+		if r.Min < -1 || r.Max < -1 {
+			return fmt.Errorf("%s: range %d has negative bound", name, i)
+		}
+		if r.Min != -1 && r.Max != -1 && r.Min >= r.Max {
+			return fmt.Errorf("%s: range %d is empty, %d >= %d", name, i, r.Min, r.Max)
+		}
+		if i > 0 && r.Min == -1 {
+			return fmt.Errorf("%s: range %d has no min", name, i)
+		}
+		if i < len(cond.Ranges)-1 && r.Max == -1 {
+			return fmt.Errorf("%s: range %d has no max", name, i)
+		}
+		if i > 0 && r.Min != cond.Ranges[i-1].Max {
+			return fmt.Errorf("%s: range %d starts at %d but range %d ends at %d", name, i, r.Min, i-1, cond.Ranges[i-1].Max)
+		}
+	}
+	return nil
+}
+
+// validateListCondition 値はカンマ区切りで指定されるので空やカンマを含む値, 重複は受け付けない
+func validateListCondition(name string, cond ListCondition) error {
+	if len(cond.List) == 0 {
+		return fmt.Errorf("%s: no values", name)
+	}
+	seen := make(map[string]bool, len(cond.List))
+	for _, v := range cond.List {
+		if v == "" || len(splitFeatures(v)) != 1 {
+			return fmt.Errorf("%s: invalid value %q", name, v)
+		}
+		if seen[v] {
+			return fmt.Errorf("%s: duplicated value %q", name, v)
+		}
+		seen[v] = true
+	}
+	return nil
+}
+
+func (cond *ChairSearchCondition) validate() error {
+	for _, rc := range []struct {
+		name string
+		cond RangeCondition
+	}{
+		{"width", cond.Width}, {"height", cond.Height}, {"depth", cond.Depth}, {"price", cond.Price},
+	} {
+		if err := validateRangeCondition(rc.name, rc.cond); err != nil {
+			return err
+		}
+	}
+	for _, lc := range []struct {
+		name string
+		cond ListCondition
+	}{
+		{"color", cond.Color}, {"feature", cond.Feature}, {"kind", cond.Kind},
+	} {
+		if err := validateListCondition(lc.name, lc.cond); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (cond *EstateSearchCondition) validate() error {
+	for _, rc := range []struct {
+		name string
+		cond RangeCondition
+	}{
+		{"doorWidth", cond.DoorWidth}, {"doorHeight", cond.DoorHeight}, {"rent", cond.Rent},
+	} {
+		if err := validateRangeCondition(rc.name, rc.cond); err != nil {
+			return err
+		}
+	}
+	return validateListCondition("feature", cond.Feature)
+}
+
+// readSearchConditions 検索条件を読んで検証する. 優先順は search_conditions に保存された管理画面の条件, ファイルの順.
+// 保存された条件がある間はファイルを書き換えて読み直しても反映されないので, DELETE /api/admin/{chair,estate}/search/condition で消す.
+// /initialize は search_conditions も作り直すのでファイルの条件に戻る
+func readSearchConditions() (*ChairSearchCondition, *EstateSearchCondition, error) {
+	var chair ChairSearchCondition
+	if err := readJSONFile(chairConditionPath, &chair); err != nil {
+		return nil, nil, err
+	}
+	var estate EstateSearchCondition
+	if err := readJSONFile(estateConditionPath, &estate); err != nil {
+		return nil, nil, err
+	}
+	if db != nil {
+		if err := readStoredSearchCondition(chairConditionTarget, &chair); err != nil {
+			return nil, nil, err
+		}
+		if err := readStoredSearchCondition(estateConditionTarget, &estate); err != nil {
+			return nil, nil, err
+		}
+	}
+	if err := chair.validate(); err != nil {
+		return nil, nil, fmt.Errorf("chair condition: %v", err)
+	}
+	if err := estate.validate(); err != nil {
+		return nil, nil, fmt.Errorf("estate condition: %v", err)
+	}
+	return &chair, &estate, nil
+}
+
+// readStoredSearchCondition search_conditions に保存された条件があれば v に読み込む
+func readStoredSearchCondition(target string, v interface{}) error {
+	var body []byte
+	err := db.Get(&body, "SELECT body FROM search_conditions WHERE target = ?", target)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("search_conditions %s: %v", target, err)
+	}
+	return nil
+}
+
+// storeSearchCondition 検索条件を search_conditions に保存する
+func storeSearchCondition(target string, v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("INSERT INTO search_conditions (target, body) VALUES (?, ?) ON DUPLICATE KEY UPDATE body = VALUES(body)", target, body)
+	return err
+}
+
+// deleteStoredSearchCondition search_conditions に保存された条件を消す
+func deleteStoredSearchCondition(target string) error {
+	_, err := db.Exec("DELETE FROM search_conditions WHERE target = ?", target)
+	return err
+}
+
+func readJSONFile(path string, v interface{}) error {
+	jsonText, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(jsonText, v); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	return nil
+}
+
+// setSearchConditions 検証済みの検索条件に差し替える. 起動時以外は searchConditionMu を取って呼ぶ
+func setSearchConditions(chair *ChairSearchCondition, estate *EstateSearchCondition) {
+	setChairSearchCondition(chair)
+	setEstateSearchCondition(estate)
+}
+
+// setChairSearchCondition 検索条件を差し替え, インデックスの範囲のバケットを作り直す.
+// 差し替え前の条件で解釈された検索はインデックスが 1 件ずつ範囲を見るので結果は変わらない
+func setChairSearchCondition(cond *ChairSearchCondition) {
+	cond.Pagination = PaginationCondition{MaxPerPage: searchMaxPerPage}
+	cond.Sort = ListCondition{List: orderNames(chairOrders)}
+	chairSearchCondition.Store(cond)
+	chairIdx.SetCondition(cond)
+}
+
+func setEstateSearchCondition(cond *EstateSearchCondition) {
+	cond.Pagination = PaginationCondition{MaxPerPage: searchMaxPerPage}
+	cond.Sort = ListCondition{List: orderNames(estateOrders)}
+	estateSearchCondition.Store(cond)
+	estateIdx.SetCondition(cond)
+}
+
+// reloadSearchConditions ファイルと DB から読み直す. 不正なら今の条件のまま err を返す
+func reloadSearchConditions() error {
+	searchConditionMu.Lock()
+	defer searchConditionMu.Unlock()
+	chair, estate, err := readSearchConditions()
+	if err != nil {
+		return err
+	}
+	setSearchConditions(chair, estate)
+	return nil
+}
+
+// watchSearchConditionReload SIGHUP で検索条件を読み直す
+func watchSearchConditionReload() {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+	go func() {
+		for range sig {
+			if err := reloadSearchConditions(); err != nil {
+				goLog.Println(err)
+				continue
+			}
+			goLog.Println("search conditions reloaded")
+		}
+	}()
+}
+
+func postReloadSearchCondition(c echo.Context) error {
+	if err := reloadSearchConditions(); err != nil {
+		goLog.Println(err)
+		c.Logger().Errorf("failed to reload search conditions: %v", err)
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Message: err.Error()})
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+func getAdminChairSearchCondition(c echo.Context) error {
+	return c.JSON(http.StatusOK, currentChairSearchCondition())
+}
+
+func getAdminEstateSearchCondition(c echo.Context) error {
+	return c.JSON(http.StatusOK, currentEstateSearchCondition())
+}
+
+// putChairSearchCondition 範囲と選択肢をまとめて置き換える. pagination と sort は無視する
+func putChairSearchCondition(c echo.Context) error {
+	var cond ChairSearchCondition
+	if err := c.Echo().JSONSerializer.Deserialize(c, &cond); err != nil {
+		c.Echo().Logger.Infof("put chair search condition failed : %v", err)
+		return c.JSON(http.StatusBadRequest, newRequestBodyError(err))
+	}
+	cond.Pagination, cond.Sort = PaginationCondition{}, ListCondition{}
+	if err := cond.validate(); err != nil {
+		c.Echo().Logger.Infof("put chair search condition failed : %v", err)
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Message: err.Error()})
+	}
+
+	searchConditionMu.Lock()
+	defer searchConditionMu.Unlock()
+	if err := storeSearchCondition(chairConditionTarget, &cond); err != nil {
+		goLog.Println(err)
+		c.Echo().Logger.Errorf("failed to store chair search condition : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	setChairSearchCondition(&cond)
+	return c.JSON(http.StatusOK, &cond)
+}
+
+// putEstateSearchCondition 範囲と選択肢をまとめて置き換える. pagination と sort は無視する
+func putEstateSearchCondition(c echo.Context) error {
+	var cond EstateSearchCondition
+	if err := c.Echo().JSONSerializer.Deserialize(c, &cond); err != nil {
+		c.Echo().Logger.Infof("put estate search condition failed : %v", err)
+		return c.JSON(http.StatusBadRequest, newRequestBodyError(err))
+	}
+	cond.Pagination, cond.Sort = PaginationCondition{}, ListCondition{}
+	if err := cond.validate(); err != nil {
+		c.Echo().Logger.Infof("put estate search condition failed : %v", err)
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Message: err.Error()})
+	}
+
+	searchConditionMu.Lock()
+	defer searchConditionMu.Unlock()
+	if err := storeSearchCondition(estateConditionTarget, &cond); err != nil {
+		goLog.Println(err)
+		c.Echo().Logger.Errorf("failed to store estate search condition : %v", err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	setEstateSearchCondition(&cond)
+	return c.JSON(http.StatusOK, &cond)
+}
+
+// deleteChairSearchCondition 管理画面で保存した条件を消してファイルの条件に戻す
+func deleteChairSearchCondition(c echo.Context) error {
+	return resetSearchCondition(c, chairConditionTarget)
+}
+
+// deleteEstateSearchCondition 管理画面で保存した条件を消してファイルの条件に戻す
+func deleteEstateSearchCondition(c echo.Context) error {
+	return resetSearchCondition(c, estateConditionTarget)
+}
+
+func resetSearchCondition(c echo.Context, target string) error {
+	searchConditionMu.Lock()
+	defer searchConditionMu.Unlock()
+	if err := deleteStoredSearchCondition(target); err != nil {
+		goLog.Println(err)
+		c.Echo().Logger.Errorf("failed to delete %s search condition : %v", target, err)
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	chair, estate, err := readSearchConditions()
+	if err != nil {
+		goLog.Println(err)
+		c.Logger().Errorf("failed to reload search conditions: %v", err)
+		return c.JSON(http.StatusBadRequest, ErrorResponse{Message: err.Error()})
+	}
+	if target == chairConditionTarget {
+		setChairSearchCondition(chair)
+		return c.JSON(http.StatusOK, chair)
+	}
+	setEstateSearchCondition(estate)
+	return c.JSON(http.StatusOK, estate)
+}
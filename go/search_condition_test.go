@@ -0,0 +1,51 @@
+package main
+
+import "testing"
+
+// TestChairIndexSetCondition 差し替え前の条件で解釈した範囲でも差し替え後のインデックスで正しく絞り込めるか
+func TestChairIndexSetCondition(t *testing.T) {
+	x := newTestChairIndex([]Chair{{ID: 1, Price: 50, Stock: 1}, {ID: 2, Price: 150, Stock: 1}, {ID: 3, Price: 250, Stock: 1}})
+	q := newChairQuery()
+	q.PriceRange = x.cond.Price.Ranges[1]
+	x.SetCondition(&ChairSearchCondition{Price: RangeCondition{Ranges: []*Range{{ID: 0, Min: -1, Max: 200}, {ID: 1, Min: 200, Max: -1}}}})
+	if n, _, _ := x.Search(q, chairOrders[0], nil, 0, 10); n != 1 {
+		t.Fatalf("stale range matched %d chairs", n)
+	}
+	q.PriceRange = x.cond.Price.Ranges[1]
+	if n, _, _ := x.Search(q, chairOrders[0], nil, 0, 10); n != 1 {
+		t.Fatalf("new range matched %d chairs", n)
+	}
+	if f := x.Facets(newChairQuery()); f.Price[0] != 2 || f.Price[1] != 1 {
+		t.Fatalf("facets %v", f.Price)
+	}
+}
+
+func TestValidateRangeCondition(t *testing.T) {
+	ok := RangeCondition{Ranges: []*Range{{ID: 0, Min: -1, Max: 10}, {ID: 1, Min: 10, Max: 20}, {ID: 2, Min: 20, Max: -1}}}
+	if err := validateRangeCondition("x", ok); err != nil {
+		t.Fatal(err)
+	}
+	for i, cond := range []RangeCondition{
+		{},
+		{Ranges: []*Range{{ID: 1, Min: -1, Max: 10}}},
+		{Ranges: []*Range{{ID: 0, Min: -1, Max: 10}, {ID: 1, Min: 11, Max: 20}}},
+		{Ranges: []*Range{{ID: 0, Min: -1, Max: 10}, {ID: 1, Min: 5, Max: 20}}},
+		{Ranges: []*Range{{ID: 0, Min: -1, Max: -1}, {ID: 1, Min: 5, Max: 20}}},
+		{Ranges: []*Range{{ID: 0, Min: 10, Max: 10}}},
+	} {
+		if validateRangeCondition("x", cond) == nil {
+			t.Fatalf("case %d accepted", i)
+		}
+	}
+}
+
+func TestValidateListCondition(t *testing.T) {
+	if err := validateListCondition("x", ListCondition{List: []string{"a", "b"}}); err != nil {
+		t.Fatal(err)
+	}
+	for _, list := range [][]string{nil, {""}, {"a,b"}, {"a", "a"}} {
+		if validateListCondition("x", ListCondition{List: list}) == nil {
+			t.Fatalf("%q accepted", list)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	goLog "log"
+	"strings"
+)
+
+// 検索の件数とページの求め方. SEARCH_COUNT_STRATEGY で選ぶ
+const (
+	// countByIndex オンメモリインデックスのビットマップから件数とページを同時に求める
+	countByIndex = "index"
+	// countByWindow COUNT(*) OVER() を付けた 1 本のクエリで件数とページを DB から取る
+	countByWindow = "window"
+)
+
+var searchCountStrategy = countByIndex
+
+func init() {
+	switch s := getEnv("SEARCH_COUNT_STRATEGY", countByIndex); s {
+	case countByIndex, countByWindow:
+		searchCountStrategy = s
+	default:
+		goLog.Printf("unknown SEARCH_COUNT_STRATEGY %q, using %q", s, countByIndex)
+	}
+}
+
+type chairCountRow struct {
+	Chair
+	SortKey    int64 `db:"sort_key"`
+	TotalCount int64 `db:"total_count"`
+}
+
+type estateCountRow struct {
+	Estate
+	SortKey    int64 `db:"sort_key"`
+	TotalCount int64 `db:"total_count"`
+}
+
+// rangeConditions Range を column >= ? AND column < ? の条件にする. r が nil なら何も足さない
+func rangeConditions(column string, r *Range, conditions []string, params []interface{}) ([]string, []interface{}) {
+	if r == nil {
+		return conditions, params
+	}
+	if r.Min != -1 {
+		conditions = append(conditions, column+" >= ?")
+		params = append(params, r.Min)
+	}
+	if r.Max != -1 {
+		conditions = append(conditions, column+" < ?")
+		params = append(params, r.Max)
+	}
+	return conditions, params
+}
+
+// boundsConditions bounds を column >= ? AND column <= ? の条件にする
+func boundsConditions(column string, b bounds, conditions []string, params []interface{}) ([]string, []interface{}) {
+	if b.Min >= 0 {
+		conditions = append(conditions, column+" >= ?")
+		params = append(params, b.Min)
+	}
+	if b.Max >= 0 {
+		conditions = append(conditions, column+" <= ?")
+		params = append(params, b.Max)
+	}
+	return conditions, params
+}
+
+// inConditions values が空でなければ column IN (?, ...) の条件にする
+func inConditions(column string, values []string, conditions []string, params []interface{}) ([]string, []interface{}) {
+	if len(values) == 0 {
+		return conditions, params
+	}
+	conditions = append(conditions, column+" IN ("+strings.Repeat(",?", len(values))[1:]+")")
+	for _, v := range values {
+		params = append(params, v)
+	}
+	return conditions, params
+}
+
+// where chairIndex.filter と同じ条件の WHERE 句. features は normalizeFeatures した形で保存されている前提
+func (q *chairQuery) where() (string, []interface{}) {
+	conditions := []string{"stock > 0"}
+	params := make([]interface{}, 0)
+	conditions, params = rangeConditions("price", q.PriceRange, conditions, params)
+	conditions, params = rangeConditions("height", q.HeightRange, conditions, params)
+	conditions, params = rangeConditions("width", q.WidthRange, conditions, params)
+	conditions, params = rangeConditions("depth", q.DepthRange, conditions, params)
+	conditions, params = boundsConditions("price", q.Price, conditions, params)
+	conditions, params = boundsConditions("height", q.Height, conditions, params)
+	conditions, params = boundsConditions("width", q.Width, conditions, params)
+	conditions, params = boundsConditions("depth", q.Depth, conditions, params)
+	conditions, params = inConditions("kind", q.Kinds, conditions, params)
+	conditions, params = inConditions("color", q.Colors, conditions, params)
+	for _, f := range q.Features {
+		conditions = append(conditions, "FIND_IN_SET(?, features) > 0")
+		params = append(params, f)
+	}
+	return strings.Join(conditions, " AND "), params
+}
+
+// where estateIndex.filter と同じ条件の WHERE 句. features は normalizeFeatures した形で保存されている前提
+func (q *estateQuery) where() (string, []interface{}) {
+	conditions := []string{"TRUE"}
+	params := make([]interface{}, 0)
+	conditions, params = rangeConditions("door_height", q.DoorHeightRange, conditions, params)
+	conditions, params = rangeConditions("door_width", q.DoorWidthRange, conditions, params)
+	conditions, params = rangeConditions("rent", q.RentRange, conditions, params)
+	conditions, params = boundsConditions("door_height", q.DoorHeight, conditions, params)
+	conditions, params = boundsConditions("door_width", q.DoorWidth, conditions, params)
+	conditions, params = boundsConditions("rent", q.Rent, conditions, params)
+	for _, f := range q.Features {
+		conditions = append(conditions, "FIND_IN_SET(?, features) > 0")
+		params = append(params, f)
+	}
+	return strings.Join(conditions, " AND "), params
+}
+
+// orderBy 並び順 o の ORDER BY 句. 既定の並び順は popularity_desc のインデックスを使う
+func (o *searchOrder) orderBy() string {
+	if o.Column == "popularity" && o.Desc {
+		return "popularity_desc ASC, id ASC"
+	}
+	if o.Desc {
+		return o.Column + " DESC, id ASC"
+	}
+	return o.Column + " ASC, id ASC"
+}
+
+// sortKeyExpr 並び順 o で比べる値を整数にする式. created_at は UTC のままエポックからのマイクロ秒にする
+func (o *searchOrder) sortKeyExpr() string {
+	if o.Column == "created_at" {
+		return "TIMESTAMPDIFF(MICROSECOND, '1970-01-01 00:00:00', created_at)"
+	}
+	return o.Column
+}
+
+// windowQuery 条件全体の件数を total_count に付けたまま並び順 o で after より後ろの limit+1 行を取るクエリ.
+// 1 行多く取って続きがあるかを判定する. o.Column は生成列や日時のこともあるので sortKeyExpr を sort_key として取り出す
+func windowQuery(table, where string, params []interface{}, o *searchOrder, after *searchCursor, offset, limit int) (string, []interface{}) {
+	query := "SELECT * FROM (SELECT *, " + o.sortKeyExpr() + " AS sort_key, COUNT(*) OVER() AS total_count FROM " + table + " WHERE " + where + ") AS t"
+	dir, cmp := "ASC", ">"
+	if o.Desc {
+		dir, cmp = "DESC", "<"
+	}
+	if after != nil {
+		query += " WHERE sort_key " + cmp + " ? OR (sort_key = ? AND id > ?)"
+		params = append(params, after.Key, after.Key, after.ID)
+	}
+	query += " ORDER BY sort_key " + dir + ", id ASC LIMIT ? OFFSET ?"
+	return query, append(params, limit+1, offset)
+}
+
+// searchChairsByWindow chairIndex.Search と同じ結果を DB から 1 クエリで求める.
+// ページが空のときだけ件数が分からないので COUNT(*) を別に投げる
+func searchChairsByWindow(q *chairQuery, o *searchOrder, after *searchCursor, offset, limit int) (int64, []Chair, *searchCursor, error) {
+	where, params := q.where()
+	query, args := windowQuery("chair", where, params, o, after, offset, limit)
+	rows := []chairCountRow{}
+	if err := db.Select(&rows, query, args...); err != nil {
+		return 0, nil, nil, err
+	}
+
+	var count int64
+	if len(rows) > 0 {
+		count = rows[0].TotalCount
+	} else if err := db.Get(&count, "SELECT COUNT(*) FROM chair WHERE "+where, params...); err != nil {
+		return 0, nil, nil, err
+	}
+
+	var next *searchCursor
+	if len(rows) > limit {
+		rows = rows[:limit]
+		last := rows[len(rows)-1]
+		next = &searchCursor{Order: o.Name, Key: last.SortKey, ID: last.ID}
+	}
+	chairs := make([]Chair, len(rows))
+	for i := range rows {
+		chairs[i] = rows[i].Chair
+	}
+	return count, chairs, next, nil
+}
+
+// searchEstatesByWindow estateIndex.Search と同じ結果を DB から 1 クエリで求める.
+// ページが空のときだけ件数が分からないので COUNT(*) を別に投げる
+func searchEstatesByWindow(q *estateQuery, o *searchOrder, after *searchCursor, offset, limit int) (int64, []Estate, *searchCursor, error) {
+	where, params := q.where()
+	query, args := windowQuery("estate", where, params, o, after, offset, limit)
+	rows := []estateCountRow{}
+	if err := db.Select(&rows, query, args...); err != nil {
+		return 0, nil, nil, err
+	}
+
+	var count int64
+	if len(rows) > 0 {
+		count = rows[0].TotalCount
+	} else if err := db.Get(&count, "SELECT COUNT(*) FROM estate WHERE "+where, params...); err != nil {
+		return 0, nil, nil, err
+	}
+
+	var next *searchCursor
+	if len(rows) > limit {
+		rows = rows[:limit]
+		last := rows[len(rows)-1]
+		next = &searchCursor{Order: o.Name, Key: last.SortKey, ID: last.ID}
+	}
+	estates := make([]Estate, len(rows))
+	for i := range rows {
+		estates[i] = rows[i].Estate
+	}
+	return count, estates, next, nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestChairQueryWhere(t *testing.T) {
+	q := newChairQuery()
+	q.PriceRange = &Range{ID: 1, Min: 100, Max: -1}
+	q.Height = bounds{Min: 2, Max: -1}
+	q.Kinds = []string{"a", "b"}
+	q.Features = []string{"x"}
+	where, params := q.where()
+	want := "stock > 0 AND price >= ? AND height >= ? AND kind IN (?,?) AND FIND_IN_SET(?, features) > 0"
+	if where != want {
+		t.Fatalf("got %q", where)
+	}
+	if !reflect.DeepEqual(params, []interface{}{int64(100), int64(2), "a", "b", "x"}) {
+		t.Fatalf("got params %v", params)
+	}
+}
+
+func TestEstateQueryWhere(t *testing.T) {
+	where, params := newEstateQuery().where()
+	if where != "TRUE" || len(params) != 0 {
+		t.Fatalf("got %q %v", where, params)
+	}
+	q := newEstateQuery()
+	q.RentRange = &Range{ID: 0, Min: -1, Max: 50000}
+	q.DoorWidth = bounds{Min: -1, Max: 80}
+	where, params = q.where()
+	if where != "TRUE AND rent < ? AND door_width <= ?" || !reflect.DeepEqual(params, []interface{}{int64(50000), int64(80)}) {
+		t.Fatalf("got %q %v", where, params)
+	}
+}
+
+func TestWindowQuery(t *testing.T) {
+	o, _ := findOrder(estateOrders, "newest")
+	query, args := windowQuery("estate", "rent < ?", []interface{}{100}, o, &searchCursor{Order: "newest", Key: 5, ID: 7}, 20, 10)
+	want := "SELECT * FROM (SELECT *, TIMESTAMPDIFF(MICROSECOND, '1970-01-01 00:00:00', created_at) AS sort_key, COUNT(*) OVER() AS total_count FROM estate WHERE rent < ?) AS t" +
+		" WHERE sort_key < ? OR (sort_key = ? AND id > ?) ORDER BY sort_key DESC, id ASC LIMIT ? OFFSET ?"
+	if query != want {
+		t.Fatalf("got %q", query)
+	}
+	if !reflect.DeepEqual(args, []interface{}{100, int64(5), int64(5), int64(7), 11, 20}) {
+		t.Fatalf("got args %v", args)
+	}
+
+	o, _ = findOrder(chairOrders, "price_asc")
+	query, _ = windowQuery("chair", "stock > 0", nil, o, nil, 0, 10)
+	want = "SELECT * FROM (SELECT *, price AS sort_key, COUNT(*) OVER() AS total_count FROM chair WHERE stock > 0) AS t ORDER BY sort_key ASC, id ASC LIMIT ? OFFSET ?"
+	if query != want {
+		t.Fatalf("got %q", query)
+	}
+}
+
+func TestNormalizeFeatures(t *testing.T) {
+	if got := normalizeFeatures(" a, b ,,a,c "); got != "a,b,c" {
+		t.Fatalf("got %q", got)
+	}
+}
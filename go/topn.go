@@ -0,0 +1,156 @@
+package main
+
+import (
+	"math/rand"
+	"sync"
+	"sync/atomic"
+)
+
+// topN less の順に並べた集合のうち先頭 n 件のスナップショットを保持する.
+// 集合は treap で持つので追加・更新・削除は O(log n), 読み出しはロックを取らない
+type topN struct {
+	mu    sync.Mutex
+	n     int
+	less  func(a, b interface{}) bool
+	key   func(v interface{}) int64
+	root  *treapNode
+	items map[int64]interface{}
+	top   []interface{}
+
+	// snapshot convert で変換した先頭 n 件
+	snapshot atomic.Value
+	convert  func(items []interface{}) interface{}
+}
+
+type treapNode struct {
+	v           interface{}
+	prio        uint32
+	left, right *treapNode
+}
+
+// newTopN key は要素の ID, convert は先頭 n 件を読み出し用の型に変換する関数
+func newTopN(n int, less func(a, b interface{}) bool, key func(v interface{}) int64, convert func(items []interface{}) interface{}) *topN {
+	t := &topN{
+		n:       n,
+		less:    less,
+		key:     key,
+		items:   map[int64]interface{}{},
+		convert: convert,
+	}
+	t.publish()
+	return t
+}
+
+// Snapshot 先頭 n 件を convert で変換したものを返す
+func (t *topN) Snapshot() interface{} {
+	return t.snapshot.Load()
+}
+
+func (t *topN) Reset(items []interface{}) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.root = nil
+	t.items = make(map[int64]interface{}, len(items))
+	for _, v := range items {
+		if old, ok := t.items[t.key(v)]; ok {
+			t.root = t.remove(t.root, old)
+		}
+		t.items[t.key(v)] = v
+		t.root = t.insert(t.root, v)
+	}
+	t.publish()
+}
+
+// Upsert 同じ ID の要素があれば置き換え, なければ追加する
+func (t *topN) Upsert(v interface{}) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	affected := t.inTop(v)
+	if old, ok := t.items[t.key(v)]; ok {
+		affected = affected || t.inTop(old)
+		t.root = t.remove(t.root, old)
+	}
+	t.items[t.key(v)] = v
+	t.root = t.insert(t.root, v)
+	if affected {
+		t.publish()
+	}
+}
+
+func (t *topN) Delete(id int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	old, ok := t.items[id]
+	if !ok {
+		return
+	}
+	delete(t.items, id)
+	t.root = t.remove(t.root, old)
+	if t.inTop(old) {
+		t.publish()
+	}
+}
+
+// inTop v が先頭 n 件に入る (入っていた) か
+func (t *topN) inTop(v interface{}) bool {
+	return len(t.top) < t.n || !t.less(t.top[len(t.top)-1], v)
+}
+
+func (t *topN) publish() {
+	top := make([]interface{}, 0, t.n)
+	stack := make([]*treapNode, 0)
+	node := t.root
+	for len(top) < t.n && (node != nil || len(stack) > 0) {
+		for node != nil {
+			stack = append(stack, node)
+			node = node.left
+		}
+		node = stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		top = append(top, node.v)
+		node = node.right
+	}
+	t.top = top
+	t.snapshot.Store(t.convert(top))
+}
+
+func (t *topN) insert(root *treapNode, v interface{}) *treapNode {
+	l, r := t.split(root, func(x interface{}) bool { return t.less(x, v) })
+	return t.merge(t.merge(l, &treapNode{v: v, prio: rand.Uint32()}), r)
+}
+
+func (t *topN) remove(root *treapNode, v interface{}) *treapNode {
+	l, r := t.split(root, func(x interface{}) bool { return t.less(x, v) })
+	_, r = t.split(r, func(x interface{}) bool { return !t.less(v, x) })
+	return t.merge(l, r)
+}
+
+// split left(x) を満たす要素とそれ以外に分ける. left は順序に対して単調であること
+func (t *topN) split(node *treapNode, left func(x interface{}) bool) (*treapNode, *treapNode) {
+	if node == nil {
+		return nil, nil
+	}
+	if left(node.v) {
+		l, r := t.split(node.right, left)
+		node.right = l
+		return node, r
+	}
+	l, r := t.split(node.left, left)
+	node.left = r
+	return l, node
+}
+
+func (t *topN) merge(a, b *treapNode) *treapNode {
+	if a == nil {
+		return b
+	}
+	if b == nil {
+		return a
+	}
+	if a.prio > b.prio {
+		a.right = t.merge(a.right, b)
+		return a
+	}
+	b.left = t.merge(a, b.left)
+	return b
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+// TestTopNMatchesSortedSlice Upsert と Delete をランダムに繰り返し, 毎回すべての行を並べ替えた先頭 n 件と比べる
+func TestTopNMatchesSortedSlice(t *testing.T) {
+	const n = 5
+	rnd := rand.New(rand.NewSource(1))
+	tn := newTopN(n, lessChairByPrice, chairID, toChairs)
+	rows := map[int64]Chair{}
+	for step := 0; step < 5000; step++ {
+		id := int64(rnd.Intn(50))
+		if rnd.Intn(3) < 2 {
+			chair := Chair{ID: id, Price: int64(rnd.Intn(20))}
+			tn.Upsert(chair)
+			rows[id] = chair
+		} else {
+			tn.Delete(id)
+			delete(rows, id)
+		}
+
+		want := make([]Chair, 0, len(rows))
+		for _, chair := range rows {
+			want = append(want, chair)
+		}
+		sort.Slice(want, func(i, j int) bool { return lessChairByPrice(want[i], want[j]) })
+		if len(want) > n {
+			want = want[:n]
+		}
+		got := tn.Snapshot().([]Chair)
+		if len(got) != len(want) {
+			t.Fatalf("step %d: got %d chairs, want %d", step, len(got), len(want))
+		}
+		for i := range got {
+			if got[i] != want[i] {
+				t.Fatalf("step %d: got %v, want %v", step, got, want)
+			}
+		}
+	}
+}
+
+func TestTopNReset(t *testing.T) {
+	tn := newTopN(2, lessChairByPrice, chairID, toChairs)
+	tn.Reset([]interface{}{Chair{ID: 1, Price: 30}, Chair{ID: 2, Price: 10}, Chair{ID: 3, Price: 20}})
+	got := tn.Snapshot().([]Chair)
+	if len(got) != 2 || got[0].ID != 2 || got[1].ID != 3 {
+		t.Fatalf("got %v", got)
+	}
+	tn.Delete(2)
+	got = tn.Snapshot().([]Chair)
+	if len(got) != 2 || got[0].ID != 3 || got[1].ID != 1 {
+		t.Fatalf("got %v after delete", got)
+	}
+}
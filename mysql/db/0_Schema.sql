@@ -6,6 +6,12 @@ DROP TABLE IF EXISTS isuumo.estate;
 
 DROP TABLE IF EXISTS isuumo.chair;
 
+DROP TABLE IF EXISTS isuumo.purchases;
+
+DROP TABLE IF EXISTS isuumo.document_requests;
+
+DROP TABLE IF EXISTS isuumo.search_conditions;
+
 CREATE TABLE isuumo.estate (
     id SMALLINT UNSIGNED NOT NULL PRIMARY KEY,
     name VARCHAR(32) NOT NULL,
@@ -20,9 +26,18 @@ CREATE TABLE isuumo.estate (
     features VARCHAR(64) NOT NULL,
     popularity INTEGER NOT NULL,
     popularity_desc MEDIUMINT AS (-popularity) INVISIBLE,
+    created_at DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+    door_area MEDIUMINT UNSIGNED AS (door_width * door_height) INVISIBLE,
+    -- 検索 (window) の WHERE 用
     INDEX (`rent`, `door_width`),
     INDEX (`rent`, `door_height`),
-    INDEX (`popularity_desc`)
+    -- おすすめの ORDER BY ... LIMIT 用. 検索 (window) は並べ替えに使えない
+    INDEX (`popularity_desc`),
+    INDEX (`rent`),
+    INDEX (`rent` DESC),
+    INDEX (`door_area`),
+    INDEX (`door_area` DESC),
+    INDEX (`created_at` DESC)
 );
 
 
@@ -41,8 +56,36 @@ CREATE TABLE isuumo.chair (
     popularity MEDIUMINT NOT NULL,
     popularity_desc MEDIUMINT AS (-popularity) INVISIBLE,
     stock TINYINT UNSIGNED NOT NULL,
+    created_at DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+    size INT UNSIGNED AS (width * height * depth) INVISIBLE,
+    -- 検索 (window) の WHERE 用. 椅子には並び順を指定する SQL のおすすめがないので並べ替え用のインデックスは置かない
     INDEX (`price`, `stock`),
     INDEX (`height`, `stock`),
-    INDEX (`kind`, `stock`),
-    INDEX (`popularity_desc`)
+    INDEX (`kind`, `stock`)
+);
+
+CREATE TABLE isuumo.purchases (
+    id BIGINT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    chair_id SMALLINT UNSIGNED NOT NULL,
+    email VARCHAR(254) NOT NULL,
+    user_agent TEXT NOT NULL,
+    remote_addr VARCHAR(64) NOT NULL,
+    created_at DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+    INDEX (`chair_id`, `created_at`)
+);
+
+CREATE TABLE isuumo.document_requests (
+    id BIGINT UNSIGNED NOT NULL AUTO_INCREMENT PRIMARY KEY,
+    estate_id SMALLINT UNSIGNED NOT NULL,
+    email VARCHAR(254) NOT NULL,
+    user_agent TEXT NOT NULL,
+    remote_addr VARCHAR(64) NOT NULL,
+    created_at DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6),
+    INDEX (`estate_id`, `created_at`)
+);
+
+CREATE TABLE isuumo.search_conditions (
+    target VARCHAR(16) NOT NULL PRIMARY KEY,
+    body JSON NOT NULL,
+    updated_at DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6) ON UPDATE CURRENT_TIMESTAMP(6)
 );
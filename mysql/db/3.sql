@@ -3,3 +3,8 @@ ALTER TABLE isuumo.estate ADD COLUMN geom POINT;
 UPDATE isuumo.estate SET geom=ST_PointFromText(CONCAT('POINT(', latitude, ' ', longitude, ')'));
 
 ALTER TABLE isuumo.estate MODIFY COLUMN geom POINT NOT NULL DEFAULT '' INVISIBLE, ADD SPATIAL INDEX(geom);
+
+-- 検索は features を前後の空白を除いたカンマ区切りとして扱うので, 初期データもその形に揃える
+UPDATE isuumo.estate SET features = REGEXP_REPLACE(TRIM(features), '[[:space:]]*,[[:space:]]*', ',');
+
+UPDATE isuumo.chair SET features = REGEXP_REPLACE(TRIM(features), '[[:space:]]*,[[:space:]]*', ',');